@@ -1,30 +1,88 @@
 package analyze
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"greasytoad/listing"
 	"greasytoad/log"
-	"hash/fnv"
 	"io"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
-type hash uint64
+// hash is the digest of a file or a directory. It is wide enough to keep the digests of files from the listings,
+// e.g. MD5 or SHA-256, so the hashes of unrelated files or directories do not collide.
+type hash [sha256.Size]byte
 
+// String returns the hash abbreviated for display.
 func (h hash) String() string {
-	return fmt.Sprintf("%x", uint64(h))
+	return hex.EncodeToString(h[:8])
+}
+
+// HashKind selects the hash of the nodes that drives the classification.
+type HashKind uint8
+
+const (
+	// ByContent compares Node.Hash, so the directories with renamed files are duplicates. It is a zero value.
+	ByContent HashKind = iota
+	// ByStructure compares Node.StructureHash, so the duplicates are literal copies.
+	ByStructure
+)
+
+// HashOf returns the hash of the given kind.
+func (n *Node) HashOf(kind HashKind) hash {
+	if kind == ByStructure {
+		return n.StructureHash()
+	}
+	return n.Hash
+}
+
+// StructureHash returns the hash that covers the names and the structure, see structureHash. It is the content hash
+// for files.
+func (n *Node) StructureHash() hash {
+	if n.structure == nil {
+		return n.Hash
+	}
+	return *n.structure
 }
 
+type NodeKind uint8
+
+const (
+	// DirNode is a zero value, so NewNode returns a directory.
+	DirNode NodeKind = iota
+	FileNode
+)
+
+// Node is a file or a directory. The loader allocates the nodes in blocks and shares the names of directories, so
+// huge listings fit in memory.
 type Node struct {
-	Name           string
-	Size           int
-	FileCount      int
-	Hash           hash
-	Children       map[string]*Node // map children node name to node
-	Parent         *Node            `json:"-"`
-	cachedFullPath *string
+	Name      string
+	Size      int64
+	Allocated int64 // bytes allocated on disk, can differ from Size for sparse or compressed files
+	FileCount int
+	Hash      hash // ignores the names, see calculateHash
+	// structure is the hash of the names and the structure of a directory, see StructureHash. It is kept out of the
+	// node, as the files do not need it.
+	structure *hash
+	Children  []*Node         // sorted by name, see Child
+	Parent    *Node           `json:"-"`
+	Header    *listing.Header `json:"-"` // set only on the root node returned by the loader
+	Kind      NodeKind
+	// Tolerated is set for the files skipped by the hashes of the directories, see LoadOpts.TolerateSize, and for the
+	// directories with only such files.
+	Tolerated bool
+	// unknownSize is set for the files without size in the listing that could not be stat-ed, their size is 0.
+	unknownSize bool
 }
 
 type SimilarityType int
@@ -41,6 +99,11 @@ const (
 	PartiallyUnique
 	// Unique not duplicated.
 	Unique
+	// Empty applicable only for directory, there are no files in the directory or its subdirectories.
+	Empty
+	// Contained applicable only for directory, all the files have copies in another directory with more files, see
+	// FindContained. It can be removed.
+	Contained
 )
 
 func (s SimilarityType) String() string {
@@ -55,20 +118,45 @@ func (s SimilarityType) String() string {
 		return "u"
 	case Unique:
 		return "U"
+	case Empty:
+		return "e"
+	case Contained:
+		return "c"
 	default:
 		return "?"
 	}
 }
 
-func (n *Node) FullPath() string {
-	if n.cachedFullPath == nil {
-		p := n.getFullPath()
-		n.cachedFullPath = &p
+// SizeMode selects how the size of the files is accounted.
+type SizeMode int
+
+const (
+	// ApparentSize is the size of the file content.
+	ApparentSize SizeMode = iota
+	// AllocatedSize is the size allocated on disk, i.e. what would be freed if the file was deleted.
+	AllocatedSize
+)
+
+// SizeOf returns the size of the node in the given mode.
+func (n *Node) SizeOf(mode SizeMode) int64 {
+	if mode == AllocatedSize {
+		return n.Allocated
 	}
-	return *n.cachedFullPath
+	return n.Size
 }
 
-func (n *Node) getFullPath() string {
+// Root returns the topmost ancestor of the node, or the node itself. The roots of several listings analyzed together
+// have no parent, see RootNames.
+func (n *Node) Root() *Node {
+	for n.Parent != nil {
+		n = n.Parent
+	}
+	return n
+}
+
+// FullPath returns the path of the node, the paths of directories end with a slash. The path is built on each call, so
+// the tree does not hold the paths of all the nodes.
+func (n *Node) FullPath() string {
 	parts := []string{}
 
 	d := n
@@ -87,7 +175,36 @@ func (n *Node) getFullPath() string {
 }
 
 func (n *Node) IsFile() bool {
-	return len(n.Children) == 0
+	return n.Kind == FileNode
+}
+
+// IsEmptyDir returns true for a directory without any files in it or in its subdirectories.
+func (n *Node) IsEmptyDir() bool {
+	return n.Kind == DirNode && n.FileCount == 0
+}
+
+// Wrapped returns the file of a wrapper directory, which holds only the file or only a wrapper directory, or nil for
+// the other nodes. See LoadOpts.DistinctWrappers.
+func (n *Node) Wrapped() *Node {
+	if n.IsFile() || len(n.Children) != 1 {
+		return nil
+	}
+	ch := n.Children[0]
+	if ch.IsFile() {
+		return ch
+	}
+	return ch.Wrapped()
+}
+
+// Child returns the child of the given name, or nil.
+func (n *Node) Child(name string) *Node {
+	i := sort.Search(len(n.Children), func(i int) bool {
+		return n.Children[i].Name >= name
+	})
+	if i < len(n.Children) && n.Children[i].Name == name {
+		return n.Children[i]
+	}
+	return nil
 }
 
 func (n *Node) FindChild(cond func(*Node) bool) *Node {
@@ -102,12 +219,9 @@ func (n *Node) FindChild(cond func(*Node) bool) *Node {
 	return nil
 }
 
+// ChildrenSlice returns a copy of the children, which can be filtered or sorted.
 func (n *Node) ChildrenSlice() []*Node {
-	children := []*Node{}
-	for _, ch := range n.Children {
-		children = append(children, ch)
-	}
-	return children
+	return append([]*Node{}, n.Children...)
 }
 
 func LoadNodesFromFileList(data io.Reader) (*Node, error) {
@@ -116,165 +230,617 @@ func LoadNodesFromFileList(data io.Reader) (*Node, error) {
 
 type LoadOpts struct {
 	FilesOrDirsToIgnore []string
+	// AllowIncompatible only warns, instead of failing, when a single input holds several listings with
+	// incompatible headers, e.g. concatenated listings made with different hash modes.
+	AllowIncompatible bool
+	// Format of the listing, detected from the first line if not set.
+	Format listing.Format
+	// StatRoot is a directory against which the files without a recorded size (e.g. from checksum manifests) are
+	// stat-ed to get the size. If empty, the size of such files is 0.
+	StatRoot string
+	// S3Schema is the order of the columns of S3 Inventory CSV, listing.DefaultS3Schema if not set.
+	S3Schema []string
+	// Lenient skips the malformed lines instead of failing, and logs a summary of them.
+	Lenient bool
+	// Rejects, if set, gets the malformed lines skipped in the lenient mode as they were read.
+	Rejects io.Writer
+	// NormalizeUnicode matches the names in different Unicode normalisation forms, e.g. NFD names from macOS with
+	// NFC names from Linux. The nodes keep the original spelling.
+	NormalizeUnicode bool
+	// FoldCase matches the names that differ only in case, e.g. copies from FAT or exFAT disks.
+	FoldCase bool
+	// HashMode selects the hash that drives the classification in listings with several hashes per file, the first
+	// hash if not set. Loading fails if a listing has no hash of this mode.
+	HashMode string
+	// Workers is the number of goroutines that parse the listing and update the tree, runtime.GOMAXPROCS if not set.
+	Workers int
+	// DistinctWrappers stops the hash of the single child of a directory from bubbling up to the directory, so a
+	// directory holding one file is not a duplicate of the bare file, and such wrapper directories are reported, see
+	// Node.Wrapped.
+	DistinctWrappers bool
+	// TolerateSize and TolerateNames select the files that are skipped by the hashes of the directories, so copies of
+	// a directory that differ only in such files are duplicates. The files stay in the tree. TolerateSize skips the
+	// files smaller than it, except the files of unknown size. TolerateNames skips the files whose names match one of
+	// the patterns of filepath.Match, the names and the patterns are matched by their keys, see FoldCase. The
+	// structure hashes do not skip any files.
+	TolerateSize  int64
+	TolerateNames []string
 }
 
-func LoadNodesFromFileListOpts(data io.Reader, opts LoadOpts) (*Node, error) {
-	filesOrDirsToIgnore := make(map[string]bool)
-	if opts.FilesOrDirsToIgnore != nil {
-		for _, name := range opts.FilesOrDirsToIgnore {
-			filesOrDirsToIgnore[name] = true
-		}
+// nameKeyFunc returns the key of a name in Node.Children, so the names that should match have the same key.
+func nameKeyFunc(opts LoadOpts) func(string) string {
+	switch {
+	case opts.FoldCase:
+		fold := cases.Fold()
+		// case folding is only stable for the normalised names.
+		return func(name string) string { return fold.String(norm.NFC.String(name)) }
+	case opts.NormalizeUnicode:
+		return norm.NFC.String
+	default:
+		return func(name string) string { return name }
 	}
+}
+
+// ignoredNames returns the set of the keys of the names of the files or directories to ignore.
+func ignoredNames(opts LoadOpts, nameKey func(string) string) map[string]bool {
+	ignored := make(map[string]bool)
+	for _, name := range opts.FilesOrDirsToIgnore {
+		ignored[nameKey(name)] = true
+	}
+	return ignored
+}
+
+// maxLoggedRejects is the number of malformed lines logged in the lenient mode, the rest is only counted.
+const maxLoggedRejects = 10
+
+func LoadNodesFromFileListOpts(data io.Reader, opts LoadOpts) (*Node, error) {
+	nameKey := nameKeyFunc(opts)
+	filesOrDirsToIgnore := ignoredNames(opts, nameKey)
 
 	shouldIgnorePath := func(chunkedPath []string) (string, bool) {
 		for _, chunk := range chunkedPath {
-			if filesOrDirsToIgnore[chunk] {
+			if filesOrDirsToIgnore[nameKey(chunk)] {
 				return chunk, true
 			}
 		}
 		return "", false
 	}
 
-	scanner := bufio.NewScanner(data)
+	reader, err := openListing(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
 
 	root := NewNode("")
+	builder := newTreeBuilder(nameKey)
+	unknownSizeCount := 0
+	if tr, ok := reader.Reader.(listing.TreeReader); ok {
+		unknownSizeCount, err = loadTree(root, builder, tr, opts, filesOrDirsToIgnore)
+	} else {
+		unknownSizeCount, err = loadEntries(root, builder, reader, opts, shouldIgnorePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if root.Header, err = reader.finish(unknownSizeCount); err != nil {
+		return nil, err
+	}
+
+	tolerated, err := newTolerance(opts, nameKey)
+	if err != nil {
+		return nil, err
+	}
+	updateTree(root, opts, nameKey, tolerated)
+
+	return root, nil
+}
+
+// tolerance tells the files that are skipped by the hashes of the directories, see LoadOpts.TolerateSize and
+// LoadOpts.TolerateNames.
+type tolerance struct {
+	size     int64
+	patterns []string
+}
+
+// newTolerance returns the tolerance of the options, with the patterns converted to the keys of names.
+func newTolerance(opts LoadOpts, nameKey func(string) string) (tolerance, error) {
+	patterns := make([]string, len(opts.TolerateNames))
+	for i, pattern := range opts.TolerateNames {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return tolerance{}, fmt.Errorf("bad pattern %s: %v", pattern, err)
+		}
+		patterns[i] = nameKey(pattern)
+	}
+	return tolerance{opts.TolerateSize, patterns}, nil
+}
+
+// file returns true if the file with the key of its name is tolerated. The files of unknown size are tolerated only
+// by name.
+func (t tolerance) file(key string, size int64, sizeKnown bool) bool {
+	if sizeKnown && size < t.size {
+		return true
+	}
+	for _, pattern := range t.patterns {
+		if ok, _ := filepath.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sortChildren sorts the children by the key of their names, so the copies of a directory that differ only in the
+// spelling of the names have the same hash. Of the children with the same key, e.g. a file listed twice, the one added
+// last is kept.
+func sortChildren(children []*Node, nameKey func(string) string) []*Node {
+	keys := make([]string, len(children))
+	for i, ch := range children {
+		keys[i] = nameKey(ch.Name)
+	}
+	sort.Stable(childrenByKey{children, keys})
+	kept := children[:0]
+	for i, ch := range children {
+		if i+1 < len(children) && keys[i+1] == keys[i] {
+			continue
+		}
+		kept = append(kept, ch)
+	}
+	return kept
+}
+
+type childrenByKey struct {
+	children []*Node
+	keys     []string
+}
+
+func (c childrenByKey) Len() int           { return len(c.children) }
+func (c childrenByKey) Less(i, j int) bool { return c.keys[i] < c.keys[j] }
+func (c childrenByKey) Swap(i, j int) {
+	c.children[i], c.children[j] = c.children[j], c.children[i]
+	c.keys[i], c.keys[j] = c.keys[j], c.keys[i]
+}
+
+// workers returns the number of goroutines for loading.
+func workers(opts LoadOpts) int {
+	if opts.Workers > 0 {
+		return opts.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// updateTree sorts the children by the key of their names, and sums up the sizes and calculates the hashes of the
+// directories from their children. The subtrees are updated in parallel by up to LoadOpts.Workers goroutines.
+func updateTree(root *Node, opts LoadOpts, nameKey func(string) string, tolerated tolerance) {
+	// slots are the goroutines that can be started in addition to the calling one.
+	slots := make(chan struct{}, workers(opts)-1)
+	var updateRec func(node *Node)
+	updateRec = func(node *Node) {
+		if node.IsFile() {
+			node.Tolerated = tolerated.file(nameKey(node.Name), node.Size, !node.unknownSize)
+			return
+		}
+		node.Children = sortChildren(node.Children, nameKey)
+		var wg sync.WaitGroup
+		for _, ch := range node.Children {
+			if len(ch.Children) == 0 {
+				updateRec(ch)
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+				wg.Add(1)
+				go func(ch *Node) {
+					defer func() { <-slots }()
+					defer wg.Done()
+					updateRec(ch)
+				}(ch)
+			default:
+				updateRec(ch)
+			}
+		}
+		wg.Wait()
+
+		var size, allocated int64 = 0, 0
+		fileCount := 0
+		for _, ch := range node.Children {
+			size += ch.Size
+			allocated += ch.Allocated
+			fileCount += ch.FileCount
+		}
+		node.Size = size
+		node.Allocated = allocated
+		node.FileCount = fileCount
+		// the root of a listing is not a wrapper, so it is reported like without DistinctWrappers.
+		node.Hash = calculateHash(node, !opts.DistinctWrappers || node.Parent == nil)
+		node.Tolerated = node.FileCount > 0 && allChildren(node, func(ch *Node) bool {
+			return ch.Tolerated || ch.IsEmptyDir()
+		})
+		children := make([]structureChild, len(node.Children))
+		for i, ch := range node.Children {
+			children[i] = structureChild{nameKey(ch.Name), ch.Kind, ch.StructureHash()}
+		}
+		structure := structureHash(children)
+		node.structure = &structure
+	}
+	updateRec(root)
+}
+
+// listingInput is a listing opened for loading. It counts the malformed lines skipped in the lenient mode.
+type listingInput struct {
+	listing.Reader
+	opts        LoadOpts
+	rejectCount int
+	rejectErr   error
+}
+
+func openListing(data io.Reader, opts LoadOpts) (*listingInput, error) {
+	in := &listingInput{opts: opts}
+	readerOpts := listing.ReaderOpts{Format: opts.Format, S3Schema: opts.S3Schema, HashMode: opts.HashMode, Workers: workers(opts)}
+	if opts.Lenient {
+		readerOpts.OnReject = in.reject
+	}
+	reader, err := listing.NewReaderOpts(data, readerOpts)
+	if err != nil {
+		return nil, err
+	}
+	in.Reader = reader
+	return in, nil
+}
 
-	for scanner.Scan() {
-		parsed, err := parseLine(scanner.Text())
+func (in *listingInput) reject(lineErr *listing.LineError) {
+	in.rejectCount++
+	if in.rejectCount <= maxLoggedRejects {
+		log.Printf("WARNING: skipping %v", lineErr)
+	} else {
+		log.Debugf("skipping %v", lineErr)
+	}
+	if in.opts.Rejects != nil && in.rejectErr == nil {
+		_, in.rejectErr = fmt.Fprintln(in.opts.Rejects, lineErr.Text)
+	}
+}
+
+// finish is called after all the entries were read. It logs the summary of the problems, and checks that the hashes
+// of all the listings in the input can be compared. It returns the first header, or nil.
+func (in *listingInput) finish(unknownSizeCount int) (*listing.Header, error) {
+	if in.rejectErr != nil {
+		return nil, fmt.Errorf("cannot write rejected lines: %v", in.rejectErr)
+	}
+	if in.rejectCount > 0 {
+		log.Printf("WARNING: skipped %d malformed lines", in.rejectCount)
+	}
+
+	if unknownSizeCount > 0 && in.opts.StatRoot == "" {
+		log.Printf("WARNING: %d files without size, their size is assumed to be 0", unknownSizeCount)
+	}
+
+	log.Debugf("listing format: %s", in.Format())
+	headers := in.Headers()
+	for _, h := range headers {
+		if in.opts.HashMode != "" && h.HashMode != "" && h.HashMode != in.opts.HashMode {
+			return nil, fmt.Errorf("listing has hash mode (%s), not (%s)", h.HashMode, in.opts.HashMode)
+		}
+		if err := listing.CheckCompatible(*headers[0], *h); err != nil {
+			if !in.opts.AllowIncompatible {
+				return nil, fmt.Errorf("incompatible listings in input: %v", err)
+			}
+			log.Printf("WARNING: incompatible listings in input: %v", err)
+		}
+	}
+	if len(headers) > 0 {
+		return headers[0], nil
+	}
+	return nil, nil
+}
+
+// loadEntries adds the entries of the listing to the tree one by one. It returns the number of files without size.
+func loadEntries(root *Node, builder *treeBuilder, reader listing.Reader, opts LoadOpts, shouldIgnorePath func([]string) (string, bool)) (int, error) {
+	unknownSizeCount := 0
+	// path is reused for the components of the paths of all the entries.
+	var path []string
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return nil, err
+			return unknownSizeCount, err
 		}
+		path = splitPath(path[:0], entry.Path)
+		parsed := newParsed(entry, path)
 
 		if match, ok := shouldIgnorePath(parsed.path); ok {
 			log.Debugf("ignore %s because of %s", parsed.fullPath, match)
 			continue
 		}
 
+		sizeKnown := true
+		if !parsed.isDir && parsed.size == listing.UnknownSize {
+			unknownSizeCount++
+			parsed.size, parsed.allocated, sizeKnown = statSize(opts.StatRoot, parsed.fullPath)
+		}
+
 		n := root
 		for i, p := range parsed.path {
-			if i == len(parsed.path)-1 {
+			if i == len(parsed.path)-1 && !parsed.isDir {
 				// last, that is the file
-				newChild := NewNode(p)
-				newChild.Size = parsed.size
-				newChild.FileCount = 1
-				newChild.Parent = n
-				newChild.Hash = calculateHashFromString(parsed.hash)
-				n.Children[p] = newChild
+				f := builder.file(n, p, parsed.size, parsed.allocated, calculateHashFromString(parsed.hash))
+				f.unknownSize = !sizeKnown
 			} else {
-				if p == "" {
+				if p == "" || p == "." {
 					continue
 				}
-				if ch, ok := n.Children[p]; ok {
-					n = ch
-				} else {
-					newChild := NewNode(p)
-					newChild.Parent = n
-					n.Children[p] = newChild
-					n = newChild
-				}
+				n = builder.dir(n, p)
 			}
 		}
 	}
+	return unknownSizeCount, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
+// loadTree adds the nodes of a tree reader, e.g. of an index. The paths are not split, and the hash of each distinct
+// file hash is calculated once. It returns the number of files without size.
+func loadTree(root *Node, builder *treeBuilder, reader listing.TreeReader, opts LoadOpts, filesOrDirsToIgnore map[string]bool) (int, error) {
+	unknownSizeCount := 0
+	// nodes maps the index of a node of the reader to the node of the tree, nil if the node is ignored.
+	nodes := []*Node{}
+	hashes := make(map[int]hash)
+	err := reader.ReadTree(func(tn listing.TreeNode) error {
+		parent := root
+		if tn.Parent >= 0 {
+			parent = nodes[tn.Parent]
+		}
+		if parent == nil || filesOrDirsToIgnore[builder.nameKey(tn.Name)] {
+			log.Debugf("ignore %s", reader.Path(tn.Index))
+			nodes = append(nodes, nil)
+			return nil
+		}
+		if tn.Dir {
+			if tn.Name == "" || tn.Name == "." {
+				nodes = append(nodes, parent)
+				return nil
+			}
+			nodes = append(nodes, builder.dir(parent, tn.Name))
+			return nil
+		}
 
-	// recalculate sizes
-	var updateSizeRec func(node *Node)
-	updateSizeRec = func(node *Node) {
-		if node.IsFile() {
-			return
+		size, allocated, sizeKnown := tn.Size, tn.Allocated, true
+		if size == listing.UnknownSize {
+			unknownSizeCount++
+			size, allocated, sizeKnown = statSize(opts.StatRoot, reader.Path(tn.Index))
 		}
-		size, fileCount := 0, 0
-		for _, ch := range node.Children {
-			updateSizeRec(ch)
-			size += ch.Size
-			fileCount += ch.FileCount
+		h, ok := hashes[tn.HashIndex]
+		if !ok {
+			selected, err := reader.Hash(tn.HashIndex)
+			if err != nil {
+				return fmt.Errorf("%s: %v", reader.Path(tn.Index), err)
+			}
+			h = calculateHashFromString(selected)
+			hashes[tn.HashIndex] = h
 		}
-		node.Size = size
-		node.FileCount = fileCount
+		f := builder.file(parent, tn.Name, size, allocated, h)
+		f.unknownSize = !sizeKnown
+		nodes = append(nodes, f)
+		return nil
+	})
+	return unknownSizeCount, err
+}
+
+// treeBuilder adds the nodes to the tree while loading. The nodes are allocated in blocks, and the names are shared,
+// as the same names repeat in backups. The directories are looked up by name in a map that is dropped after loading.
+// The files are only appended, a file listed twice is replaced when the children are sorted, see sortChildren.
+type treeBuilder struct {
+	nameKey func(string) string
+	dirs    map[childKey]*Node
+	names   map[string]string
+	block   []Node
+}
+
+type childKey struct {
+	parent *Node
+	name   string
+}
+
+// nodeBlockSize is the number of nodes allocated at once.
+const nodeBlockSize = 1024
+
+func newTreeBuilder(nameKey func(string) string) *treeBuilder {
+	return &treeBuilder{
+		nameKey: nameKey,
+		dirs:    make(map[childKey]*Node),
+		names:   make(map[string]string),
 	}
-	updateSizeRec(root)
+}
 
-	// recalculate hashes
-	var updateHashRec func(node *Node)
-	updateHashRec = func(node *Node) {
-		for _, ch := range node.Children {
-			updateHashRec(ch)
-		}
-		node.Hash = calculateHash(node)
+// name returns the shared copy of the name. The name is a part of the line of the listing, so it is copied to not keep
+// the line in memory.
+func (b *treeBuilder) name(name string) string {
+	shared, ok := b.names[name]
+	if !ok {
+		shared = strings.Clone(name)
+		b.names[shared] = shared
 	}
-	updateHashRec(root)
+	return shared
+}
 
-	return root, nil
+// dir returns the directory of the given name in the parent, and adds it if it does not exist.
+func (b *treeBuilder) dir(parent *Node, name string) *Node {
+	key := childKey{parent, b.nameKey(name)}
+	if ch, ok := b.dirs[key]; ok {
+		return ch
+	}
+	ch := b.newNode(parent, b.name(name))
+	if key.name == name {
+		// share the name with the node, the key is a part of the line as well.
+		key.name = ch.Name
+	} else {
+		key.name = strings.Clone(key.name)
+	}
+	b.dirs[key] = ch
+	return ch
+}
+
+// file adds the file to the parent. A file of the same name added before is replaced by sortChildren.
+func (b *treeBuilder) file(parent *Node, name string, size, allocated int64, h hash) *Node {
+	ch := b.newNode(parent, b.name(name))
+	ch.Kind = FileNode
+	ch.Size = size
+	ch.Allocated = allocated
+	ch.FileCount = 1
+	ch.Hash = h
+	return ch
 }
 
+func (b *treeBuilder) newNode(parent *Node, name string) *Node {
+	if len(b.block) == 0 {
+		b.block = make([]Node, nodeBlockSize)
+	}
+	n := &b.block[0]
+	b.block = b.block[1:]
+	n.Name = name
+	n.Parent = parent
+	parent.Children = append(parent.Children, n)
+	return n
+}
+
+// minDigestSize is the size of the shortest digest of a listing kept as is, the size of MD5.
+const minDigestSize = 16
+
+// calculateHashFromString returns the hash of a file from its hash in the listing. A hexadecimal digest after the
+// hash mode is kept as is, other hashes, e.g. the group ids of fdupes output, are hashed.
 func calculateHashFromString(s string) hash {
-	h := fnv.New64a()
-	io.WriteString(h, s)
-	return hash(h.Sum64())
+	var h hash
+	if len(s) > 1 {
+		if digest, err := hex.DecodeString(s[1:]); err == nil && len(digest) >= minDigestSize && len(digest) <= len(h) {
+			copy(h[:], digest)
+			return h
+		}
+	}
+	return sha256.Sum256([]byte(s))
 }
 
-func calculateHash(node *Node) hash {
-	h := fnv.New64a()
+func calculateHash(node *Node, bubble bool) hash {
 	if node.IsFile() {
 		// hash for files is already calculated during ingest of the input data.
 		return node.Hash
-	} else {
-		// a directory derives the hash from its children. Does not take into account
-		// directory name, so we can find changed dirs with the same content.
-		children := []*Node{}
-		for _, ch := range node.Children {
-			children = append(children, ch)
+	}
+	// a directory derives the hash from its children. Does not take into account
+	// directory name, so we can find changed dirs with the same content. Empty directories
+	// have no content, so they are skipped as well.
+	// the children are sorted by the key of their names.
+	all := make([]hash, 0, len(node.Children))
+	children := make([]hash, 0, len(node.Children))
+	for _, ch := range node.Children {
+		if ch.IsEmptyDir() {
+			continue
 		}
-		sort.Slice(children, func(i, j int) bool {
-			return children[i].Name < children[j].Name
-		})
-		if len(children) == 1 {
-			// bubble up hash of a single child.
-			return children[0].Hash
-		} else {
-			for _, ch := range children {
-				b := []byte(strconv.Itoa(int(ch.Hash)))
-				h.Write(b)
-			}
+		all = append(all, ch.Hash)
+		if !ch.Tolerated {
+			children = append(children, ch.Hash)
 		}
 	}
+	if len(children) == 0 {
+		// a directory of only tolerated files is compared by all of them, the parent skips it anyway.
+		children = all
+	}
+	return hashOfChildren(children, bubble)
+}
 
-	return hash(h.Sum64())
+// structureChild is a child of a directory for structureHash.
+type structureChild struct {
+	name string
+	kind NodeKind
+	hash hash
 }
 
-func NewNode(name string) *Node {
-	return &Node{
-		Name:     name,
-		Children: make(map[string]*Node),
+// structureHashTag starts the content hashed for the structure of a directory.
+const structureHashTag = 's'
+
+// structureHash returns the hash of a directory that covers the names, the kinds and the structure hashes of all the
+// children, including the empty directories. The hash of a file is its content hash, the name of a file is covered by
+// its parent. The names are matched by the key of the loading options, and the children are sorted by it.
+func structureHash(children []structureChild) hash {
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	d := sha256.New()
+	d.Write(binary.AppendUvarint([]byte{structureHashTag}, uint64(len(children))))
+	for _, ch := range children {
+		b := binary.AppendUvarint(nil, uint64(len(ch.name)))
+		b = append(b, ch.name...)
+		d.Write(append(b, byte(ch.kind)))
+		d.Write(ch.hash[:])
+	}
+	var h hash
+	d.Sum(h[:0])
+	return h
+}
+
+// dirHashTag starts the content hashed for a directory, so it differs from the content of a file.
+const dirHashTag = 'd'
+
+// hashOfChildren returns the hash of a directory from the hashes of its children that are not empty directories. If
+// bubble is set, the hash of a single child bubbles up. Otherwise the number of the children and their hashes, which
+// have a fixed size, are hashed, so different lists of children never hash the same content.
+func hashOfChildren(children []hash, bubble bool) hash {
+	if len(children) == 1 && bubble {
+		return children[0]
+	}
+	d := sha256.New()
+	d.Write(binary.AppendUvarint([]byte{dirHashTag}, uint64(len(children))))
+	for _, ch := range children {
+		d.Write(ch[:])
 	}
+	var h hash
+	d.Sum(h[:0])
+	return h
+}
+
+func NewNode(name string) *Node {
+	return &Node{Name: name}
 }
 
 type parsed struct {
-	path     []string
-	fullPath string
-	size     int
-	hash     string
-}
-
-func parseLine(line string) (parsed, error) {
-	line = strings.Trim(line, "\n")
-	parts := strings.Split(line, "\t")
-	parsed := parsed{}
-	if len(parts) != 3 {
-		return parsed, fmt.Errorf("bad line: %d parts, `%v`", len(parts), line)
-	}
-	parsed.fullPath = parts[0]
-	parsed.path = strings.Split(parsed.fullPath, "/")
-	size, err := strconv.ParseInt(parts[1], 10, 32)
+	path      []string
+	fullPath  string
+	isDir     bool
+	size      int64
+	hash      string
+	allocated int64
+}
+
+func newParsed(entry listing.Entry, path []string) parsed {
+	return parsed{
+		path:      path,
+		fullPath:  entry.Path,
+		isDir:     entry.Dir,
+		size:      entry.Size,
+		hash:      entry.Hash,
+		allocated: entry.Allocated,
+	}
+}
+
+// splitPath appends the components of the path to the slice like strings.Split does, so the slice can be reused.
+func splitPath(components []string, path string) []string {
+	for {
+		component, rest, found := strings.Cut(path, "/")
+		components = append(components, component)
+		if !found {
+			return components
+		}
+		path = rest
+	}
+}
+
+// statSize returns the size of the file under statRoot, or 0 and false if the file cannot be stat-ed.
+func statSize(statRoot, path string) (size int64, allocated int64, ok bool) {
+	if statRoot == "" {
+		return 0, 0, false
+	}
+	info, err := os.Stat(filepath.Join(statRoot, path))
 	if err != nil {
-		return parsed, err
+		log.Printf("WARNING: cannot get size: %v", err)
+		return 0, 0, false
 	}
-	parsed.size = int(size)
-	parsed.hash = parts[2]
-	return parsed, nil
+	return info.Size(), info.Size(), true
 }
 
 type AnalizeOpts int32
@@ -4,7 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"greasytoad/listing"
 	"greasytoad/log"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
 
@@ -33,8 +39,8 @@ func TestFindSimilarSimple(t *testing.T) {
 
 	// assert.Equal(t, 3, len(left.Similar))
 	// assert.Contains(t, left.Similar, right)
-	// assert.Contains(t, left.Similar, right.Children["a1"])
-	// assert.Contains(t, left.Similar, right.Children["a1"].Children["b1"])
+	// assert.Contains(t, left.Similar, right.Child("a1"))
+	// assert.Contains(t, left.Similar, right.Child("a1").Child("b1"))
 	// assert.Equal(t, FullDuplicate, left.SimilarityType)
 }
 
@@ -47,14 +53,31 @@ func TestHash(t *testing.T) {
 	// printNode(t, "node", node)
 
 	assert.Equal(t,
-		node.Children["a1"].Hash,
-		node.Children["a1"].Children["b1"].Hash)
+		node.Child("a1").Hash,
+		node.Child("a1").Child("b1").Hash)
 	assert.NotEqual(t,
-		node.Children["a1"].Children["b1"].Children["c1"].Hash,
-		node.Children["a1"].Children["b1"].Children["c2"].Hash)
+		node.Child("a1").Child("b1").Child("c1").Hash,
+		node.Child("a1").Child("b1").Child("c2").Hash)
 	assert.Equal(t,
-		node.Children["a1"].Children["b1"].Children["c1"].Hash,
-		node.Children["a2"].Children["b2"].Children["c1"].Hash)
+		node.Child("a1").Child("b1").Child("c1").Hash,
+		node.Child("a2").Child("b2").Child("c1").Hash)
+}
+
+func TestHashKeepsFileDigest(t *testing.T) {
+	md5 := "e8a5da2185eb0563c20079ce3ca263ba"
+	h := calculateHashFromString("h" + md5)
+	assert.Equal(t, md5, fmt.Sprintf("%x", h[:16]))
+	assert.Equal(t, "e8a5da2185eb0563", h.String())
+	// the group ids of fdupes output are not digests.
+	assert.NotEqual(t, calculateHashFromString("g12"), calculateHashFromString("g1200"))
+}
+
+func TestDirHashEncodesChildren(t *testing.T) {
+	a, b := calculateHashFromString("ha"), calculateHashFromString("hb")
+	assert.Equal(t, a, hashOfChildren([]hash{a}, true))
+	assert.NotEqual(t, hashOfChildren([]hash{a, b}, true), hashOfChildren([]hash{b, a}, true))
+	assert.NotEqual(t, hashOfChildren([]hash{a, b}, true), hashOfChildren([]hash{a, b, b}, true))
+	assert.NotEqual(t, hashOfChildren(nil, true), hashOfChildren([]hash{a, a}, true))
 }
 
 func TestFindSimilarOneFileInDifferentFolder(t *testing.T) {
@@ -74,8 +97,8 @@ func TestFindSimilarOneFileInDifferentFolder(t *testing.T) {
 	// // printNode(t, "right", left)
 	// AnalyzeDuplicates(left, right)
 	// assert.Equal(t, 1, len(left.Similar))
-	// // assert.Equal(t, right.Children["a1"].Children["b1"], left.Similar[0])
-	// // assert.Equal(t, similar[0], left.Children["a1"].Children["b1"])
+	// // assert.Equal(t, right.Child("a1").Child("b1"), left.Similar[0])
+	// // assert.Equal(t, similar[0], left.Child("a1").Child("b1"))
 	// // assert.Equal(t, similar[0].FullPath(), "/a1/b1")
 }
 
@@ -86,30 +109,920 @@ func TestLoadLines(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, "", root.Name)
-	assert.Equal(t, 3, root.Size)
+	assert.Equal(t, int64(3), root.Size)
 	assert.Equal(t, 2, root.FileCount)
 
-	foo := root.Children["foo"]
+	foo := root.Child("foo")
 	assert.Equal(t, "foo", foo.Name)
-	assert.Equal(t, 3, foo.Size)
+	assert.Equal(t, int64(3), foo.Size)
 	assert.Equal(t, 2, foo.FileCount)
 
-	bar := foo.Children["bar"]
+	bar := foo.Child("bar")
 	assert.Equal(t, "bar", bar.Name)
-	assert.Equal(t, 1, bar.Size)
+	assert.Equal(t, int64(1), bar.Size)
 	assert.Equal(t, 1, bar.FileCount)
 
-	baz := bar.Children["baz"]
+	baz := bar.Child("baz")
 	assert.Equal(t, "baz", baz.Name)
-	assert.Equal(t, 1, baz.Size)
+	assert.Equal(t, int64(1), baz.Size)
 	assert.Equal(t, 1, baz.FileCount)
 
-	quux := foo.Children["quux"]
+	quux := foo.Child("quux")
 	assert.Equal(t, "quux", quux.Name)
-	assert.Equal(t, 2, quux.Size)
+	assert.Equal(t, int64(2), quux.Size)
 	assert.Equal(t, 1, quux.FileCount)
 }
 
+func TestLoadLargeSizes(t *testing.T) {
+	node := loadNodeFromString(t, `
+/a/big1 3000000000 h1
+/a/big2 5000000000000 h2
+`)
+	assert.Equal(t, int64(3000000000), node.Child("a").Child("big1").Size)
+	assert.Equal(t, int64(5003000000000), node.Child("a").Size)
+	assert.Equal(t, int64(5003000000000), node.Size)
+}
+
+func TestLoadHeader(t *testing.T) {
+	r := bytes.NewBufferString("#listing\t1\n#hash\th\n#algorithm\tmd5\n#root\t/foo\n#host\tbox\n" +
+		"#start\t2021-01-02T03:04:05Z\n#tool\tdev\n/foo/bar\t1\thb1\n#end\t2021-01-02T03:04:06Z\n")
+	root, err := LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), root.Size)
+	assert.NotNil(t, root.Header)
+	assert.Equal(t, 1, root.Header.Version)
+	assert.Equal(t, "h", root.Header.HashMode)
+	assert.Equal(t, "md5", root.Header.Algorithm)
+	assert.Equal(t, "/foo", root.Header.Root)
+	assert.Equal(t, "box", root.Header.Host)
+	assert.Equal(t, "dev", root.Header.Tool)
+	assert.Equal(t, 6, root.Header.End.Second())
+}
+
+func TestLoadLegacyHeaderInfersHashMode(t *testing.T) {
+	root := loadNodeFromString(t, `
+/a/b 1 sb1
+`)
+	assert.Equal(t, 0, root.Header.Version)
+	assert.Equal(t, "s", root.Header.HashMode)
+}
+
+func TestLoadIncompatibleListings(t *testing.T) {
+	input := "#listing\t1\n#hash\th\n/a/b\t1\thb1\n#listing\t1\n#hash\tn\n/c/d\t1\tnd1\n"
+
+	_, err := LoadNodesFromFileList(bytes.NewBufferString(input))
+	assert.Error(t, err)
+
+	root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(input), LoadOpts{AllowIncompatible: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, root.FileCount)
+}
+
+func TestLoadNewerVersion(t *testing.T) {
+	_, err := LoadNodesFromFileList(bytes.NewBufferString("#listing\t99\n/a/b\t1\thb1\n"))
+	assert.Error(t, err)
+}
+
+func TestLoadMalformedLineFailsWithLineNumber(t *testing.T) {
+	_, err := LoadNodesFromFileList(bytes.NewBufferString("\n/a/b\t1\thb1\n/a/c\t1\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 3:")
+	var lineErr *listing.LineError
+	assert.ErrorAs(t, err, &lineErr)
+	assert.Equal(t, "/a/c\t1", lineErr.Text)
+}
+
+func TestLoadLenient(t *testing.T) {
+	input := "\n/a/b\t1\thb1\n/a/c\t1\n\n/a/d\tx\thd1\n/a/e\t2\the1\n"
+	rejects := &bytes.Buffer{}
+	root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(input), LoadOpts{Lenient: true, Rejects: rejects})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, root.FileCount)
+	assert.Equal(t, int64(3), root.Size)
+	assert.Equal(t, "/a/c\t1\n/a/d\tx\thd1\n", rejects.String())
+}
+
+func TestLoadNormalizeUnicode(t *testing.T) {
+	nfc, nfd := "caf\u00e9", "cafe\u0301"
+	input := fmt.Sprintf("/%s/a\t1\tha\n/%s/b\t1\thb\n", nfd, nfc)
+
+	root, err := LoadNodesFromFileList(bytes.NewBufferString(input))
+	assert.NoError(t, err)
+	assert.Len(t, root.Children, 2)
+
+	root, err = LoadNodesFromFileListOpts(bytes.NewBufferString(input), LoadOpts{NormalizeUnicode: true})
+	assert.NoError(t, err)
+	assert.Len(t, root.Children, 1)
+	dir := root.Child(nfd)
+	assert.Equal(t, nfd, dir.Name, "the first spelling is kept")
+	assert.Equal(t, 2, dir.FileCount)
+}
+
+func TestLoadFoldCase(t *testing.T) {
+	input := "/Photos/a.JPG\t1\tha\n/photos/b.jpg\t1\thb\n/PHOTOS/A.jpg\t1\tha\n"
+	root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(input), LoadOpts{FoldCase: true, FilesOrDirsToIgnore: []string{"B.JPG"}})
+	assert.NoError(t, err)
+	assert.Len(t, root.Children, 1)
+	dir := root.Child("Photos")
+	assert.Equal(t, "Photos", dir.Name)
+	assert.Equal(t, 1, dir.FileCount)
+	assert.Equal(t, "/Photos/A.jpg", dir.Child("A.jpg").FullPath())
+}
+
+func TestFoldCaseDirHash(t *testing.T) {
+	input := "/x/a.jpg\t1\tha\n/x/C.JPG\t2\thc\n/y/A.JPG\t1\tha\n/y/C.JPG\t2\thc\n"
+	load := func(foldCase bool) *Node {
+		root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(input), LoadOpts{FoldCase: foldCase})
+		assert.NoError(t, err)
+		return root
+	}
+	root := load(true)
+	// the children are in the same order, though "C.JPG" sorts before "a.jpg" and after "A.JPG".
+	assert.Equal(t, root.Child("x").Hash, root.Child("y").Hash)
+	assert.Equal(t, root.Child("x").StructureHash(), root.Child("y").StructureHash())
+	root = load(false)
+	assert.NotEqual(t, root.Child("x").StructureHash(), root.Child("y").StructureHash())
+}
+
+func TestLoadMultiHash(t *testing.T) {
+	input := "#listing\t4\n#hash\tn,h\n/a/x\t1\tnx,h1\n/a/y\t1\tny,h1\n"
+	load := func(mode string) (*Node, error) {
+		return LoadNodesFromFileListOpts(bytes.NewBufferString(input), LoadOpts{HashMode: mode})
+	}
+
+	root, err := load("")
+	assert.NoError(t, err)
+	assert.Equal(t, "n", root.Header.HashMode)
+	a := root.Child("a")
+	assert.NotEqual(t, a.Child("x").Hash, a.Child("y").Hash)
+
+	root, err = load("h")
+	assert.NoError(t, err)
+	assert.Equal(t, "h", root.Header.HashMode)
+	a = root.Child("a")
+	assert.Equal(t, a.Child("x").Hash, a.Child("y").Hash)
+
+	_, err = load("s")
+	assert.Error(t, err)
+}
+
+func TestLoadSingleHashWithOtherHashMode(t *testing.T) {
+	_, err := LoadNodesFromFileListOpts(bytes.NewBufferString("#listing\t3\n#hash\tn\n/a/x\t1\tnx\n"), LoadOpts{HashMode: "h"})
+	assert.Error(t, err)
+}
+
+func TestLoadDirEntries(t *testing.T) {
+	root := loadNodeFromString(t, `
+/a/ 0 -
+/a/e/ 0 -
+/a/f 0 hf
+/a/g 1 hg
+`)
+	a := root.Child("a")
+	assert.False(t, a.IsFile())
+	assert.Equal(t, 2, a.FileCount)
+
+	e := a.Child("e")
+	assert.False(t, e.IsFile())
+	assert.True(t, e.IsEmptyDir())
+	assert.Equal(t, "/a/e/", e.FullPath())
+
+	f := a.Child("f")
+	assert.True(t, f.IsFile())
+	assert.False(t, f.IsEmptyDir())
+	assert.Equal(t, "/a/f", f.FullPath())
+}
+
+func TestEmptyDirDoesNotChangeHash(t *testing.T) {
+	root := loadNodeFromString(t, `
+/a/f 1 hf
+/a/g 1 hg
+/a/e/ 0 -
+/b/f 1 hf
+/b/g 1 hg
+`)
+	assert.Equal(t, root.Child("a").Hash, root.Child("b").Hash)
+}
+
+func TestFindSimilarEmptyDirs(t *testing.T) {
+	root := loadNodeFromString(t, `
+/a/e1/ 0 -
+/a/e2/sub/ 0 -
+/a/f 1 hf
+/b/f 1 hf
+`)
+	found := make(map[string]SimilarityType)
+	FindSimilarities(root, func(st SimilarityType, nodes []*Node) {
+		for _, n := range nodes {
+			found[n.FullPath()] = st
+		}
+	})
+	assert.Equal(t, Empty, found["/a/e1/"])
+	assert.Equal(t, Empty, found["/a/e2/"])
+	assert.Equal(t, FullDuplicate, found["/a/f"])
+}
+
+func TestLoadAllocatedSize(t *testing.T) {
+	root := loadNodeFromString(t, `
+/a/sparse 1000000 h1 4096
+/a/legacy 10 h2
+`)
+	a := root.Child("a")
+	assert.Equal(t, int64(4096), a.Child("sparse").Allocated)
+	assert.Equal(t, int64(10), a.Child("legacy").Allocated)
+	assert.Equal(t, int64(1000010), a.SizeOf(ApparentSize))
+	assert.Equal(t, int64(4106), a.SizeOf(AllocatedSize))
+}
+
+func TestLoadJSONLines(t *testing.T) {
+	r := bytes.NewBufferString(`{"header":{"version":3,"hash_mode":"h","root":"/foo"}}
+{"path":"/foo","dir":true}
+{"path":"/foo/e","dir":true}
+{"path":"/foo/bar\tbaz","size":1,"hash":"hb1","allocated":4096}
+{"path":"/foo/quux","size":2,"hash":"hq2"}
+{"trailer":{"end":"2021-01-02T03:04:06Z"}}
+`)
+	root, err := LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "h", root.Header.HashMode)
+	assert.Equal(t, "/foo", root.Header.Root)
+	assert.False(t, root.Header.End.IsZero())
+
+	foo := root.Child("foo")
+	assert.Equal(t, int64(3), foo.Size)
+	assert.Equal(t, int64(4098), foo.Allocated)
+	assert.Equal(t, 2, foo.FileCount)
+	assert.True(t, foo.Child("e").IsEmptyDir())
+	assert.True(t, foo.Child("bar\tbaz").IsFile())
+}
+
+func TestLoadJSONLinesForcedFormat(t *testing.T) {
+	_, err := LoadNodesFromFileListOpts(bytes.NewBufferString("/a/b\t1\thb\n"), LoadOpts{Format: listing.JSON})
+	assert.Error(t, err)
+}
+
+func TestLoadCompressed(t *testing.T) {
+	for _, c := range []listing.Compression{listing.Gzip, listing.Zstd} {
+		buf := &bytes.Buffer{}
+		w, err := listing.NewCompressWriter(buf, c)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte("/foo/bar\t1\thb1\n/foo/quux\t2\thq2\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		root, err := LoadNodesFromFileList(buf)
+		assert.NoError(t, err, "compression %s", c)
+		assert.Equal(t, int64(3), root.Size, "compression %s", c)
+		assert.Equal(t, 2, root.FileCount, "compression %s", c)
+	}
+}
+
+func TestLoadChecksumManifest(t *testing.T) {
+	r := bytes.NewBufferString(`e8a5da2185eb0563c20079ce3ca263ba  ./a/x1
+E2EE9AD17FDFFB4D4085276497DFB647 *./a/x2
+\e8a5da2185eb0563c20079ce3ca263ba  ./b/new\nline
+`)
+	root, err := LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "h", root.Header.HashMode)
+	assert.Equal(t, "md5", root.Header.Algorithm)
+	assert.Equal(t, 3, root.FileCount)
+	assert.Equal(t, int64(0), root.Size)
+
+	a := root.Child("a")
+	assert.Equal(t, calculateHashFromString("he2ee9ad17fdffb4d4085276497dfb647"), a.Child("x2").Hash)
+	assert.Equal(t, a.Child("x1").Hash, root.Child("b").Child("new\nline").Hash)
+}
+
+func TestLoadBSDChecksumManifest(t *testing.T) {
+	r := bytes.NewBufferString("SHA256 (a/x1) = 50313adddde6034b1eb0bffe6bba93a5ef922b5f013efbd95781f7fcc58db3f7\n")
+	root, err := LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256", root.Header.Algorithm)
+	assert.True(t, root.Child("a").Child("x1").IsFile())
+
+	// b2sum --tag
+	r = bytes.NewBufferString("BLAKE2b (a/x1) = " + strings.Repeat("0123456789abcdef", 8) + "\n")
+	root, err = LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "blake2b", root.Header.Algorithm)
+	assert.True(t, root.Child("a").Child("x1").IsFile())
+}
+
+func TestLoadChecksumManifestWithStat(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "x1"), []byte("abc"), 0644))
+	r := bytes.NewBufferString("e8a5da2185eb0563c20079ce3ca263ba  x1\ne8a5da2185eb0563c20079ce3ca263ba  missing\n")
+	root, err := LoadNodesFromFileListOpts(r, LoadOpts{StatRoot: dir})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), root.Child("x1").Size)
+	assert.Equal(t, int64(0), root.Child("missing").Size)
+}
+
+func TestLoadFdupes(t *testing.T) {
+	r := bytes.NewBufferString(`3 bytes each:
+/a/x1
+/b/b1/x1
+
+/a/x2
+/b/b1/x2
+/b/b2/x2
+
+`)
+	root, err := LoadNodesFromFileListOpts(r, LoadOpts{Format: listing.Fdupes})
+	assert.NoError(t, err)
+	assert.Equal(t, "g", root.Header.HashMode)
+	assert.Equal(t, 5, root.FileCount)
+	assert.Equal(t, int64(6), root.Size)
+
+	a, b1, b2 := root.Child("a"), root.Child("b").Child("b1"), root.Child("b").Child("b2")
+	assert.Equal(t, a.Child("x1").Hash, b1.Child("x1").Hash)
+	assert.Equal(t, a.Child("x2").Hash, b2.Child("x2").Hash)
+	assert.NotEqual(t, a.Child("x1").Hash, a.Child("x2").Hash)
+	assert.Equal(t, a.Hash, b1.Hash)
+}
+
+func TestLoadFdupesCommaInPath(t *testing.T) {
+	input := "/x/a,1\n/y/b\n\n/x/a,2\n/z/q\n"
+	for _, hashMode := range []string{"", "g"} {
+		root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(input), LoadOpts{Format: listing.Fdupes, HashMode: hashMode})
+		assert.NoError(t, err)
+		x := root.Child("x")
+		// the groups are not merged by the part of the first path before the comma.
+		assert.Equal(t, x.Child("a,1").Hash, root.Child("y").Child("b").Hash)
+		assert.NotEqual(t, x.Child("a,1").Hash, x.Child("a,2").Hash)
+	}
+}
+
+func TestLoadRmlint(t *testing.T) {
+	r := bytes.NewBufferString(`[
+{
+  "description": "rmlint json-dump of lint files",
+  "cwd": "/data",
+  "version": "2.10.1",
+  "checksum_type": "blake2b"
+},
+{
+  "id": 1,
+  "type": "duplicate_file",
+  "digest": "ab12",
+  "path": "/data/a/x1",
+  "size": 3,
+  "is_original": true
+},
+{
+  "id": 2,
+  "type": "duplicate_file",
+  "digest": "ab12",
+  "path": "/data/b/x1",
+  "size": 3,
+  "is_original": false
+},
+{
+  "id": 3,
+  "type": "emptydir",
+  "path": "/data/e",
+  "size": 0
+},
+{
+  "aborted": false,
+  "progress": 100
+}
+]
+`)
+	root, err := LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "rmlint/blake2b", root.Header.Algorithm)
+	assert.Equal(t, "/data", root.Header.Root)
+	data := root.Child("data")
+	assert.Equal(t, 2, data.FileCount)
+	assert.Equal(t, data.Child("a").Hash, data.Child("b").Hash)
+	assert.True(t, data.Child("e").IsEmptyDir())
+}
+
+func TestLoadS3Inventory(t *testing.T) {
+	r := bytes.NewBufferString(`"photos","2020/img%201.jpg","3","2021-01-02T03:04:05.000Z","e8a5da2185eb0563c20079ce3ca263ba","STANDARD"
+"photos","2020/img2.jpg","3","2021-01-02T03:04:05.000Z","d41d8cd98f00b204e9800998ecf8427e-2","STANDARD"
+"photos","2020/","0","2021-01-02T03:04:05.000Z","d41d8cd98f00b204e9800998ecf8427e","STANDARD"
+"photos","2019/","0","2021-01-02T03:04:05.000Z","d41d8cd98f00b204e9800998ecf8427e","STANDARD"
+`)
+	root, err := LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "h", root.Header.HashMode)
+	assert.Equal(t, "md5", root.Header.Algorithm)
+
+	photos := root.Child("photos")
+	assert.Equal(t, 2, photos.FileCount)
+	assert.Equal(t, int64(6), photos.Size)
+	assert.Equal(t, calculateHashFromString("he8a5da2185eb0563c20079ce3ca263ba"), photos.Child("2020").Child("img 1.jpg").Hash)
+	assert.True(t, photos.Child("2019").IsEmptyDir())
+}
+
+func TestLoadS3InventorySchema(t *testing.T) {
+	r := bytes.NewBufferString(`"photos","a.jpg","v1","true","false","3","e8a5da2185eb0563c20079ce3ca263ba"
+"photos","a.jpg","v0","false","false","4","e2ee9ad17fdffb4d4085276497dfb647"
+"photos","b.jpg","v2","true","true","",""
+`)
+	schema := listing.ParseS3Schema("Bucket, Key, VersionId, IsLatest, IsDeleteMarker, Size, ETag")
+	root, err := LoadNodesFromFileListOpts(r, LoadOpts{S3Schema: schema})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, root.FileCount)
+	assert.Equal(t, int64(3), root.Child("photos").Child("a.jpg").Size)
+}
+
+func TestLoadRclone(t *testing.T) {
+	r := bytes.NewBufferString(`[
+{"Path":"2020","Name":"2020","Size":-1,"MimeType":"inode/directory","ModTime":"2021-01-02T03:04:05Z","IsDir":true},
+{"Path":"2020/img1.jpg","Name":"img1.jpg","Size":3,"MimeType":"image/jpeg","ModTime":"2021-01-02T03:04:05Z","IsDir":false,"Hashes":{"md5":"E8A5DA2185EB0563C20079CE3CA263BA","sha1":"aa"}},
+{"Path":"2020/img2.jpg","Name":"img2.jpg","Size":3,"MimeType":"image/jpeg","ModTime":"2021-01-02T03:04:05Z","IsDir":false,"Hashes":{"md5":"e2ee9ad17fdffb4d4085276497dfb647"}}
+]
+`)
+	cloud, err := LoadNodesFromFileList(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "h", cloud.Header.HashMode)
+	assert.Equal(t, "md5", cloud.Header.Algorithm)
+	assert.Equal(t, 2, cloud.FileCount)
+
+	local := loadNodeFromString(t, `
+/photos/2020/img1.jpg 3 he8a5da2185eb0563c20079ce3ca263ba
+/photos/2020/img2.jpg 3 he2ee9ad17fdffb4d4085276497dfb647
+`)
+	assert.Equal(t, local.Child("photos").Child("2020").Hash, cloud.Child("2020").Hash)
+}
+
+func TestLoadIndex(t *testing.T) {
+	text := "/a/\t0\t-\t0\n/a/x1\t3\thx1\t4096\n/a/x2\t3\thx2\t4096\n/b/x1\t3\thx1\t4096\n/b/x2\t3\thx2\t4096\n"
+	fromText, err := LoadNodesFromFileList(bytes.NewBufferString(text))
+	assert.NoError(t, err)
+
+	r, err := listing.NewReader(bytes.NewBufferString(text), listing.AutoFormat)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "listing.idx")
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, listing.WriteIndex(f, r))
+	assert.NoError(t, f.Close())
+
+	// a file is memory mapped
+	f, err = os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	fromIndex, err := LoadNodesFromFileList(f)
+	assert.NoError(t, err)
+
+	assert.Equal(t, fromText.Hash, fromIndex.Hash)
+	assert.Equal(t, fromText.Size, fromIndex.Size)
+	assert.Equal(t, fromText.Allocated, fromIndex.Allocated)
+	assert.Equal(t, fromText.FileCount, fromIndex.FileCount)
+	assert.Equal(t, fromText.Child("a").Hash, fromIndex.Child("b").Hash)
+}
+
+func TestLoadIndexSeveralHashes(t *testing.T) {
+	text := "#listing\t3\n#hash\tn,h\n/a/x1\t3\tnx,hx1\t0\n/a/x2\t3\tny,hx2\t0\n/b/x1\t3\tnx,hx1\t0\n/b/x2\t3\tny,hx3\t0\n"
+	r, err := listing.NewReaderOpts(bytes.NewBufferString(text), listing.ReaderOpts{AllHashes: true})
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "listing.idx")
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, listing.WriteIndex(f, r))
+	assert.NoError(t, f.Close())
+
+	for _, mode := range []string{"", "n", "h"} {
+		fromText, err := LoadNodesFromFileListOpts(bytes.NewBufferString(text), LoadOpts{HashMode: mode})
+		assert.NoError(t, err)
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+		fromIndex, err := LoadNodesFromFileListOpts(f, LoadOpts{HashMode: mode})
+		assert.NoError(t, f.Close())
+		assert.NoError(t, err, mode)
+		assert.Equal(t, fromText.Header.HashMode, fromIndex.Header.HashMode, mode)
+		assert.Equal(t, fromText.Child("a").Hash, fromIndex.Child("a").Hash, mode)
+		// the copies differ only by the full content hash.
+		assert.Equal(t, mode != "h", fromIndex.Child("a").Hash == fromIndex.Child("b").Hash, mode)
+	}
+}
+
+func TestLoadParallel(t *testing.T) {
+	data := benchmarkListing(20000)
+	serial, err := LoadNodesFromFileListOpts(bytes.NewReader(data), LoadOpts{Workers: 1})
+	assert.Nil(t, err)
+	parallel, err := LoadNodesFromFileListOpts(bytes.NewReader(data), LoadOpts{Workers: 8})
+	assert.Nil(t, err)
+	describe := func(root *Node) []string {
+		nodes := []string{}
+		WalkAll(root, func(n *Node) {
+			nodes = append(nodes, fmt.Sprintf("%s %d %d %d %d", n.FullPath(), n.Size, n.Allocated, n.FileCount, n.Hash))
+		})
+		return nodes
+	}
+	assert.Equal(t, describe(serial), describe(parallel))
+}
+
+func TestFindSimilarByStructure(t *testing.T) {
+	root := loadNodeFromString(t, `
+/a/f 1 hf
+/a/g 2 hg
+/a/e/ 0 -
+/copy/f 1 hf
+/copy/g 2 hg
+/copy/e/ 0 -
+/renamed/f2 1 hf
+/renamed/g 2 hg
+/renamed/e/ 0 -
+/noempty/f 1 hf
+/noempty/g 2 hg
+`)
+	assert.Equal(t, root.Child("a").Hash, root.Child("renamed").Hash)
+	assert.Equal(t, root.Child("a").Hash, root.Child("noempty").Hash)
+	assert.Equal(t, root.Child("a").StructureHash(), root.Child("copy").StructureHash())
+	assert.NotEqual(t, root.Child("a").StructureHash(), root.Child("renamed").StructureHash())
+	assert.NotEqual(t, root.Child("a").StructureHash(), root.Child("noempty").StructureHash())
+
+	found := make(map[string][]*Node)
+	FindSimilaritiesOpts(root, SimilarityOpts{Hash: ByStructure}, func(st SimilarityType, nodes []*Node) {
+		if st == FullDuplicate {
+			for _, n := range nodes {
+				found[n.FullPath()] = nodes
+			}
+		}
+	})
+	assert.Len(t, found["/a/"], 2)
+	assert.Equal(t, "/copy/", found["/a/"][1].FullPath())
+	assert.Nil(t, found["/renamed/"])
+}
+
+func TestFindSimilarDistinctWrappers(t *testing.T) {
+	data := "/w1/f\t1\thf\n/w2/f\t1\thf\n/other/f\t1\thf\n/other/g\t2\thg\n"
+	duplicates := func(opts LoadOpts) []string {
+		root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(data), opts)
+		assert.Nil(t, err)
+		found := []string{}
+		FindSimilarities(root, func(st SimilarityType, nodes []*Node) {
+			if st == FullDuplicate {
+				found = append(found, strings.Join(FormatNodes(nodes, (*Node).FullPath), " "))
+			}
+		})
+		external := []string{}
+		err = FindSimilaritiesExternal([]io.Reader{bytes.NewBufferString(data)}, ExternalOpts{LoadOpts: opts}, func(st SimilarityType, paths []string) {
+			if st == FullDuplicate {
+				external = append(external, strings.Join(paths, " "))
+			}
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, found, external)
+		return found
+	}
+	// the wrappers have the hash of the file, so the group of the file is reported for each of them.
+	group := "/other/f /w1/f /w2/f"
+	assert.Equal(t, []string{group, group, group}, duplicates(LoadOpts{}))
+	assert.Equal(t, []string{group, "/w1/ /w2/"}, duplicates(LoadOpts{DistinctWrappers: true}))
+
+	// the root of the listing is not a wrapper, so it is reported once under the root of merged listings.
+	loaded, err := LoadNodesFromFileListOpts(bytes.NewBufferString("/r/a/w/f\t1\thf\n/r/b/f\t1\thf\n/r/b/g\t2\thg\n"), LoadOpts{DistinctWrappers: true})
+	assert.Nil(t, err)
+	merged := NewNode("")
+	merged.Children = append(merged.Children, loaded)
+	merged.FileCount = loaded.FileCount
+	roots := 0
+	FindSimilarities(merged, func(st SimilarityType, nodes []*Node) {
+		if nodes[0].FullPath() == "/" {
+			roots++
+		}
+	})
+	assert.Equal(t, 1, roots)
+
+	root := loadNodeFromString(t, "/w1/sub/f 1 hf\n/other/f 1 hf\n/other/g 2 hg")
+	assert.Equal(t, "/w1/sub/f", root.Child("w1").Wrapped().FullPath())
+	assert.Nil(t, root.Child("other").Wrapped())
+	assert.Nil(t, root.Child("other").Child("f").Wrapped())
+}
+
+func TestFindSimilarTolerated(t *testing.T) {
+	data := strings.ReplaceAll(`/a/p1.jpg 100 h1
+/a/p2.jpg 200 h2
+/a/desktop.ini 10 hini1
+/b/p1.jpg 100 h1
+/b/p2.jpg 200 h2
+/b/desktop.ini 12 hini2
+/b/x.lock 0 hempty
+/c/desktop.ini 10 hini1
+`, " ", "\t")
+	opts := LoadOpts{TolerateSize: 1, TolerateNames: []string{"desktop.ini", ".picasa.ini"}}
+	root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(data), opts)
+	assert.Nil(t, err)
+	assert.True(t, root.Child("a").Child("desktop.ini").Tolerated)
+	assert.True(t, root.Child("b").Child("x.lock").Tolerated)
+	assert.False(t, root.Child("b").Child("p1.jpg").Tolerated)
+	assert.True(t, root.Child("c").Tolerated)
+	// the tolerated files stay in the tree.
+	assert.Equal(t, 4, root.Child("b").FileCount)
+
+	found := make(map[string][]*Node)
+	FindSimilarities(root, func(st SimilarityType, nodes []*Node) {
+		for _, n := range nodes {
+			found[n.FullPath()] = nodes
+		}
+	})
+	duplicates := found["/a/"]
+	assert.Equal(t, []string{"/a/", "/b/"}, FormatNodes(duplicates, (*Node).FullPath))
+	assert.Equal(t, []string{"/a/desktop.ini", "/b/desktop.ini", "/b/x.lock"}, FormatNodes(ToleratedDifferences(duplicates, opts), (*Node).FullPath))
+
+	root, err = LoadNodesFromFileList(bytes.NewBufferString(data))
+	assert.Nil(t, err)
+	assert.NotEqual(t, root.Child("a").Hash, root.Child("b").Hash)
+
+	_, err = LoadNodesFromFileListOpts(bytes.NewBufferString(data), LoadOpts{TolerateNames: []string{"["}})
+	assert.Error(t, err)
+}
+
+func TestToleratedKeysAndUnknownSizes(t *testing.T) {
+	// the manifest has no sizes, so only the names are tolerated.
+	data := `e8a5da2185eb0563c20079ce3ca263ba  a/p1.jpg
+c4ca4238a0b923820dcc509a6f75849b  a/p2.jpg
+e2ee9ad17fdffb4d4085276497dfb647  a/Desktop.ini
+e8a5da2185eb0563c20079ce3ca263ba  b/p1.jpg
+c4ca4238a0b923820dcc509a6f75849b  b/p2.jpg
+d41d8cd98f00b204e9800998ecf8427e  b/desktop.ini
+e8a5da2185eb0563c20079ce3ca263ba  c/p1.jpg
+c4ca4238a0b923820dcc509a6f75849b  c/p2.jpg
+eccbc87e4b5ce2fe28308fd9f2a7baf3  c/p3.jpg
+`
+	opts := LoadOpts{FoldCase: true, TolerateSize: 1, TolerateNames: []string{"desktop.ini"}}
+	root, err := LoadNodesFromFileListOpts(bytes.NewBufferString(data), opts)
+	assert.Nil(t, err)
+	assert.True(t, root.Child("a").Child("Desktop.ini").Tolerated)
+	assert.False(t, root.Child("c").Child("p3.jpg").Tolerated)
+	assert.Equal(t, root.Child("a").Hash, root.Child("b").Hash)
+	assert.NotEqual(t, root.Child("a").Hash, root.Child("c").Hash)
+
+	expected := []string{}
+	FindSimilarities(root, func(st SimilarityType, nodes []*Node) {
+		expected = append(expected, fmt.Sprintf("%s %s", st, FormatNodes(nodes, (*Node).FullPath)))
+	})
+	assert.Contains(t, expected, "D [/a/ /b/]")
+	actual := []string{}
+	err = FindSimilaritiesExternal([]io.Reader{bytes.NewBufferString(data)}, ExternalOpts{LoadOpts: opts, TempDir: t.TempDir()}, func(st SimilarityType, paths []string) {
+		actual = append(actual, fmt.Sprintf("%s %s", st, paths))
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, actual, "D [/a/ /b/]")
+	assert.NotContains(t, actual, "D [/a/ /b/ /c/]")
+
+	// the same tolerated file spelled differently is not a difference.
+	data = "/a/p1.jpg\t1\th1\n/a/p2.jpg\t2\th2\n/a/Desktop.ini\t5\thini\n" +
+		"/b/p1.jpg\t1\th1\n/b/p2.jpg\t2\th2\n/b/desktop.ini\t5\thini\n/b/x.ini\t5\thx\n"
+	opts = LoadOpts{FoldCase: true, TolerateNames: []string{"*.ini"}}
+	root, err = LoadNodesFromFileListOpts(bytes.NewBufferString(data), opts)
+	assert.Nil(t, err)
+	nodes := []*Node{root.Child("a"), root.Child("b")}
+	assert.Equal(t, []string{"/b/x.ini"}, FormatNodes(ToleratedDifferences(nodes, opts), (*Node).FullPath))
+}
+
+func TestFindNearDuplicates(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(buf, "/x/album/p%d\t100\th%d\n", i, i)
+		if i < 10 {
+			fmt.Fprintf(buf, "/y/album/p%d\t100\th%d\n", i, i)
+		}
+	}
+	fmt.Fprintf(buf, "/y/album/p11\t300\th11\n")
+	fmt.Fprintf(buf, "/z/other\t100\th1\n/z/more\t1000\thmore\n")
+	root, err := LoadNodesFromFileList(buf)
+	assert.Nil(t, err)
+
+	found := []NearDuplicate{}
+	FindNearDuplicates(root, NearDuplicateOpts{Threshold: 0.5}, func(nd NearDuplicate) {
+		found = append(found, nd)
+	})
+	assert.Len(t, found, 1)
+	nd := found[0]
+	// the albums are reported as their parents, which have the same files.
+	assert.Equal(t, []string{"/x/", "/y/"}, FormatNodes(nd.Nodes[:], (*Node).FullPath))
+	assert.InDelta(t, 900.0/1300.0, nd.Score, 0.0001)
+	assert.Equal(t, []string{"/x/album/p10"}, FormatNodes(nd.Differences[0], (*Node).FullPath))
+	assert.Equal(t, []string{"/y/album/p11"}, FormatNodes(nd.Differences[1], (*Node).FullPath))
+
+	found = found[:0]
+	FindNearDuplicates(root, NearDuplicateOpts{Threshold: 0.8, ByFileCount: true}, func(nd NearDuplicate) {
+		found = append(found, nd)
+	})
+	assert.Len(t, found, 1)
+	assert.InDelta(t, 9.0/11.0, found[0].Score, 0.0001)
+
+	found = found[:0]
+	FindNearDuplicates(root, NearDuplicateOpts{Threshold: 0.8}, func(nd NearDuplicate) {
+		found = append(found, nd)
+	})
+	assert.Empty(t, found)
+}
+
+func TestFindNearDuplicatesCommonFiles(t *testing.T) {
+	buf := &bytes.Buffer{}
+	// most of the shared weight is a file with too many copies to find the pair by.
+	for _, dir := range []string{"x", "y"} {
+		fmt.Fprintf(buf, "/%s/common\t1000\thcommon\n/%s/rare\t100\thrare\n/%s/own\t50\th%s\n", dir, dir, dir, dir)
+	}
+	for i := 0; i < nearCandidateCopies; i++ {
+		fmt.Fprintf(buf, "/c%d/common\t1000\thcommon\n", i)
+	}
+	root, err := LoadNodesFromFileList(buf)
+	assert.Nil(t, err)
+
+	found := []NearDuplicate{}
+	FindNearDuplicates(root, NearDuplicateOpts{Threshold: 0.9}, func(nd NearDuplicate) {
+		found = append(found, nd)
+	})
+	assert.Len(t, found, 1)
+	assert.Equal(t, []string{"/x/", "/y/"}, FormatNodes(found[0].Nodes[:], (*Node).FullPath))
+	assert.InDelta(t, 1100.0/1200.0, found[0].Score, 0.0001)
+}
+
+func TestFindContained(t *testing.T) {
+	root := loadNodeFromString(t, `
+/old/a 1 ha
+/old/sub/b 2 hb
+/new/2019/a 1 ha
+/new/2019/b 2 hb
+/new/2019/c 3 hc
+/new/2020/d 4 hd
+/copy/a 1 ha
+/copy/sub/b 2 hb
+/other/a 1 ha
+/other/x 5 hx
+`)
+	found := []string{}
+	FindContained(root, func(c Containment) {
+		found = append(found, fmt.Sprintf("%s %s %v", c.Node.FullPath(), c.Container.FullPath(), FormatNodes(c.Extra(), (*Node).FullPath)))
+	})
+	// the smallest container is reported, and not the directories under the contained ones.
+	assert.Equal(t, []string{"/copy/ /new/2019/ [/new/2019/c]", "/old/ /new/2019/ [/new/2019/c]"}, found)
+}
+
+func TestFindContainedCopyInSmallerDir(t *testing.T) {
+	root := loadNodeFromString(t, `
+/r/old/f1 1 h1
+/r/old/f2 2 h2
+/r/znew/sub/f1 1 h1
+/r/znew/f2 2 h2
+/r/znew/f3 3 h3
+`)
+	found := []string{}
+	FindContained(root, func(c Containment) {
+		found = append(found, fmt.Sprintf("%s %s", c.Node.FullPath(), c.Container.FullPath()))
+	})
+	// the copy of the rarest file is in a subdirectory smaller than the contained directory.
+	assert.Equal(t, []string{"/r/old/ /r/znew/"}, found)
+}
+
+func TestFindContainedCrosswise(t *testing.T) {
+	root := loadNodeFromString(t, `
+/a/d1/f1 1 h1
+/a/d1/f2 2 h2
+/a/d2/f3 3 h3
+/a/d2/f4 4 h4
+/b/e1/f1 1 h1
+/b/e1/f3 3 h3
+/b/e2/f2 2 h2
+/b/e2/f4 4 h4
+`)
+	found := []string{}
+	FindContained(root, func(c Containment) {
+		found = append(found, fmt.Sprintf("%s %s %v", c.Node.FullPath(), c.Container.FullPath(), FormatNodes(c.Extra(), (*Node).FullPath)))
+	})
+	// the directories of /b are also in /a, but removing them with the ones of /a would lose the files.
+	assert.Equal(t, []string{"/a/d1/ /b/ [/b/e1/f3 /b/e2/f4]", "/a/d2/ /b/ [/b/e1/f1 /b/e2/f2]"}, found)
+}
+
+func TestFindSimilaritiesRootFilter(t *testing.T) {
+	inputs := []string{
+		"/m/f1\t1\th1\n/m/f2\t2\th2\n/m/x\t5\th5\n/dup1/f3\t3\th3\n/dup1/f4\t4\th4\n/dup2/f3\t3\th3\n/dup2/f4\t4\th4",
+		"/old/f1\t1\th1\n/old/x\t5\th5\n/x\t5\th5\n",
+	}
+	root := mergeListings(t, inputs)
+	groups := func(filter RootFilter) []string {
+		expected := []string{}
+		FindSimilaritiesOpts(root, SimilarityOpts{Roots: filter}, func(st SimilarityType, nodes []*Node) {
+			expected = append(expected, fmt.Sprintf("%s %v %s", st, CountByRoot(nodes), FormatNodes(nodes, (*Node).FullPath)))
+		})
+		actual := []string{}
+		opts := ExternalOpts{SimilarityOpts: SimilarityOpts{Roots: filter}, TempDir: t.TempDir()}
+		err := FindSimilaritiesExternal(stringReaders(inputs), opts, func(st SimilarityType, paths []string) {
+			actual = append(actual, fmt.Sprintf("%s %v %s", st, CountPathsByRoot(paths, true), paths))
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, actual)
+		return expected
+	}
+	// the groups under several roots are reported only as crossing them, even with several copies under a root.
+	assert.Equal(t, []string{"D [{a 1} {b 1}] [a/m/f1 b/old/f1]", "D [{a 1} {b 2}] [a/m/x b/old/x b/x]"}, groups(CrossRoots))
+	assert.Equal(t, []string{"D [{a 2}] [a/dup1/ a/dup2/]"}, groups(IntraRoot))
+	assert.Len(t, groups(AllRoots), 9)
+}
+
+func TestFindSimilaritiesExternal(t *testing.T) {
+	data := `
+/a/e1/ 0 -
+/a/f 1 hf
+/a/g 2 hg
+/a/x/y/f 1 hf
+/b/f 1 hf
+/b/g 2 hg
+/c/u 3 hu
+/c/sub/f 1 hf
+/c/sub/g 2 hg
+/c/sub/h 4 hh
+/d/u2 5 hu2
+/e/renamed 1 hf
+/e/g 2 hg
+`
+	data = strings.ReplaceAll(strings.Trim(data, " \n"), " ", "\t")
+	for _, input := range [][]byte{[]byte(data), benchmarkListing(5000)} {
+		for _, kind := range []HashKind{ByContent, ByStructure} {
+			// the tolerated files are skipped by the hashes of the directories the same way.
+			tolerateNames := []string{"u*"}
+			root, err := LoadNodesFromFileListOpts(bytes.NewReader(input), LoadOpts{TolerateNames: tolerateNames})
+			assert.Nil(t, err)
+			expected := []string{}
+			FindSimilaritiesOpts(root, SimilarityOpts{Hash: kind}, func(st SimilarityType, nodes []*Node) {
+				expected = append(expected, fmt.Sprintf("%s %s", st, FormatNodes(nodes, (*Node).FullPath)))
+			})
+
+			// a small run size sorts the records in many runs on disk.
+			opts := ExternalOpts{SimilarityOpts: SimilarityOpts{Hash: kind}, TempDir: t.TempDir(), RunSize: 1 << 10}
+			opts.TolerateNames = tolerateNames
+			actual := []string{}
+			err = FindSimilaritiesExternal([]io.Reader{bytes.NewReader(input)}, opts, func(st SimilarityType, paths []string) {
+				actual = append(actual, fmt.Sprintf("%s %s", st, paths))
+			})
+			assert.Nil(t, err)
+			assert.NotEmpty(t, actual)
+			assert.Equal(t, expected, actual)
+		}
+	}
+}
+
+func TestRecordSorterManyRuns(t *testing.T) {
+	tempDir := t.TempDir()
+	// each record is written to a separate run, so the runs are merged in two passes.
+	s := newRecordSorter(tempDir, 1)
+	const count = 2*maxMergeRuns + 7
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("%03d", i%1000))
+		assert.NoError(t, s.add(newRecord(key, []byte(fmt.Sprint(i)))))
+	}
+	previous, read := "", 0
+	err := s.each(func(record []byte) error {
+		if read == 0 {
+			files, err := os.ReadDir(tempDir)
+			assert.NoError(t, err)
+			assert.LessOrEqual(t, len(files), maxMergeRuns)
+		}
+		// the records with equal keys keep the order of adding.
+		current := fmt.Sprintf("%s %07s", recordKey(record), recordPayload(record))
+		assert.Less(t, previous, current)
+		previous = current
+		read++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, count, read)
+	files, err := os.ReadDir(tempDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFindSimilaritiesExternalRemovesTempFiles(t *testing.T) {
+	inputs := []io.Reader{
+		strings.NewReader("/x/f\t1\thf\n/x/g\t2\thg\n/y/u\t3\thu"),
+		strings.NewReader("/z/f\t1\thf\nmalformed\n"),
+	}
+	tempDir := t.TempDir()
+	// each record is written to a separate run.
+	opts := ExternalOpts{TempDir: tempDir, RunSize: 1}
+	err := FindSimilaritiesExternal(inputs, opts, func(SimilarityType, []string) {})
+	assert.Error(t, err)
+	files, err := os.ReadDir(tempDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFindSimilaritiesExternalSeveralListings(t *testing.T) {
+	inputs := []string{"/x/f\t1\thf\n/x/g\t2\thg\n/y/u\t3\thu", "/z/f\t1\thf\n/z/g\t2\thg\n/z/e/\t0\t-"}
+	root := mergeListings(t, inputs)
+	expected := []string{}
+	FindSimilarities(root, func(st SimilarityType, nodes []*Node) {
+		expected = append(expected, fmt.Sprintf("%s %s", st, FormatNodes(nodes, (*Node).FullPath)))
+	})
+
+	actual := []string{}
+	err := FindSimilaritiesExternal(stringReaders(inputs), ExternalOpts{TempDir: t.TempDir()}, func(st SimilarityType, paths []string) {
+		actual = append(actual, fmt.Sprintf("%s %s", st, paths))
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
 func TestNoUnknownSimilarity(t *testing.T) {
 	t.Skip()
 	loadNodeFromString(t, `
@@ -139,6 +1052,139 @@ func TestNoUnknownSimilarity(t *testing.T) {
 	// })
 }
 
+// benchmarkListing returns a listing of a photo archive like tree, where a quarter of the files have a copy in a backup
+// directory.
+func benchmarkListing(fileCount int) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "#listing\t%d\n#hash\th\n", listing.FormatVersion)
+	for i := 0; i < fileCount; i++ {
+		dir := fmt.Sprintf("/archive/photos/%d/%02d/%02d", 2000+i/20000, i/2000%12+1, i/100%20+1)
+		if i%4 == 3 {
+			dir = "/archive/backup" + dir
+		}
+		fmt.Fprintf(buf, "%s/IMG_%05d.JPG\t%d\th%032x\t%d\n", dir, i%100000, 1000+i, i/2, 4096)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkLoad(b *testing.B) {
+	log.DebugEnabled = false
+	const fileCount = 200000
+	data := benchmarkListing(fileCount)
+	loaders := []struct {
+		name string
+		load func() (interface{}, error)
+	}{
+		// map is the baseline, the layout of the tree before it was compacted.
+		{"map", func() (interface{}, error) { return loadMapTree(data) }},
+		{"tree", func() (interface{}, error) { return LoadNodesFromFileList(bytes.NewReader(data)) }},
+	}
+	for _, loader := range loaders {
+		b.Run(loader.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := loader.load(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			// the memory held by the tree after loading.
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			root, _ := loader.load()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(root)
+			runtime.KeepAlive(data)
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/fileCount, "heap-B/file")
+		})
+	}
+}
+
+// mapNode is a node of the tree as it was before the children were kept in sorted slices allocated in blocks: a map of
+// the children in each directory, a copy of the name in each node and a cached full path. It has the hashes of today.
+type mapNode struct {
+	Name           string
+	Kind           NodeKind
+	Size           int64
+	Allocated      int64
+	FileCount      int
+	Hash           hash
+	Children       map[string]*mapNode
+	Parent         *mapNode
+	Header         *listing.Header
+	cachedFullPath *string
+}
+
+// loadMapTree loads the listing into mapNode trees, sums up the sizes and hashes the directories like the loader, so
+// the baseline does the same work.
+func loadMapTree(data []byte) (*mapNode, error) {
+	r, err := listing.NewReader(bytes.NewReader(data), listing.AutoFormat)
+	if err != nil {
+		return nil, err
+	}
+	root := &mapNode{Children: make(map[string]*mapNode)}
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		n := root
+		parts := strings.Split(e.Path, "/")
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+			ch, ok := n.Children[p]
+			if !ok {
+				ch = &mapNode{Name: strings.Clone(p), Parent: n, Children: make(map[string]*mapNode)}
+				n.Children[ch.Name] = ch
+			}
+			if i == len(parts)-1 && !e.Dir {
+				ch.Kind, ch.Children = FileNode, nil
+				ch.Size, ch.Allocated, ch.FileCount = e.Size, e.Allocated, 1
+				ch.Hash = calculateHashFromString(e.Hash)
+			}
+			n = ch
+		}
+	}
+	var sumRec func(n *mapNode)
+	sumRec = func(n *mapNode) {
+		if n.Kind == FileNode {
+			return
+		}
+		children := []hash{}
+		for _, ch := range n.Children {
+			sumRec(ch)
+			n.Size += ch.Size
+			n.Allocated += ch.Allocated
+			n.FileCount += ch.FileCount
+			children = append(children, ch.Hash)
+		}
+		sort.Slice(children, func(i, j int) bool { return bytes.Compare(children[i][:], children[j][:]) < 0 })
+		n.Hash = hashOfChildren(children, true)
+	}
+	sumRec(root)
+	return root, nil
+}
+
+func BenchmarkFindSimilarities(b *testing.B) {
+	log.DebugEnabled = false
+	root, err := LoadNodesFromFileList(bytes.NewReader(benchmarkListing(200000)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FindSimilarities(root, func(SimilarityType, []*Node) {})
+	}
+}
+
 func loadNodeFromString(t *testing.T, s string) *Node {
 	s = strings.Trim(s, " \n")
 	s = strings.ReplaceAll(s, " ", "\t")
@@ -149,6 +1195,27 @@ func loadNodeFromString(t *testing.T, s string) *Node {
 	return n
 }
 
+// mergeListings loads the listings under a root like the analyze command does, the roots of the listings are named a,
+// b, ... and have no parent.
+func mergeListings(t *testing.T, inputs []string) *Node {
+	root := NewNode("")
+	for i, input := range inputs {
+		node := loadNodeFromString(t, input)
+		node.Name = string(rune('a' + i))
+		root.Children = append(root.Children, node)
+		root.FileCount += node.FileCount
+	}
+	return root
+}
+
+func stringReaders(inputs []string) []io.Reader {
+	readers := []io.Reader{}
+	for _, input := range inputs {
+		readers = append(readers, strings.NewReader(input))
+	}
+	return readers
+}
+
 func printNode(t *testing.T, label string, n *Node) {
 	if j, err := json.MarshalIndent(n, "", " "); err == nil {
 		t.Log(string(j))
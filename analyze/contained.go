@@ -0,0 +1,199 @@
+package analyze
+
+import (
+	"sort"
+)
+
+// Containment is a directory whose files all have copies in another, bigger directory, so it can be removed.
+type Containment struct {
+	Node      *Node
+	Container *Node
+	// ExtraCount is the number of the files of the container that the directory does not have.
+	ExtraCount int
+}
+
+// Extra returns the files of the container that the directory does not have. They are found on each call, so the
+// containments do not hold the files of big containers.
+func (c Containment) Extra() []*Node {
+	extra, _ := containedIn(contentFiles(c.Node), contentFiles(c.Container))
+	return extra
+}
+
+// FindContained calls onContained with the directories whose files are all in another directory, with the smallest
+// such container. The directories under a reported one are not reported. The exact duplicates and the directories with
+// the same files as the container are left to FindSimilarities. The containers are looked up through the copies of the
+// file with the fewest copies, a directory is not reported if that file has more than a few copies. The tolerated
+// files are skipped, see LoadOpts.TolerateSize.
+//
+// All the reported directories can be removed together: a container is never under a reported directory nor holds
+// one, so the files of each reported directory are kept in the ones that are not reported.
+func FindContained(root *Node, onContained func(Containment)) {
+	// order and end are the interval of each node in the pre-order walk, copies are the files by hash in that order,
+	// and counts are the numbers of the files under each directory.
+	order := make(map[*Node]int)
+	end := make(map[*Node]int)
+	counts := make(map[*Node]int)
+	copies := make(map[hash][]*Node)
+	// rarest is the hash of the file of each directory with the fewest copies, set after all the copies are known.
+	rarest := make(map[*Node]hash)
+	var indexRec func(n *Node) int
+	indexRec = func(n *Node) int {
+		order[n] = len(order)
+		defer func() { end[n] = len(order) }()
+		if n.IsFile() {
+			if n.Tolerated {
+				return 0
+			}
+			copies[n.Hash] = append(copies[n.Hash], n)
+			return 1
+		}
+		count := 0
+		for _, ch := range n.Children {
+			count += indexRec(ch)
+		}
+		counts[n] = count
+		return count
+	}
+	indexRec(root)
+	var rarestRec func(n *Node) (hash, bool)
+	rarestRec = func(n *Node) (hash, bool) {
+		if n.IsFile() {
+			return n.Hash, !n.Tolerated
+		}
+		var found hash
+		ok := false
+		for _, ch := range n.Children {
+			if h, chOK := rarestRec(ch); chOK && (!ok || len(copies[h]) < len(copies[found])) {
+				found, ok = h, true
+			}
+		}
+		if ok {
+			rarest[n] = found
+		}
+		return found, ok
+	}
+	rarestRec(root)
+
+	// copiesUnder returns the number of the copies of the file under the directory.
+	copiesUnder := func(h hash, dir *Node) int {
+		files := copies[h]
+		from := sort.Search(len(files), func(i int) bool { return order[files[i]] >= order[dir] })
+		to := sort.Search(len(files), func(i int) bool { return order[files[i]] >= end[dir] })
+		return to - from
+	}
+	// reported are the reported directories, and reportedBelow counts them under each directory.
+	reported := make(map[*Node]bool)
+	reportedBelow := make(map[*Node]int)
+	overlapsReported := func(n *Node) bool {
+		if reportedBelow[n] > 0 {
+			return true
+		}
+		for p := n; p != nil; p = p.Parent {
+			if reported[p] {
+				return true
+			}
+		}
+		return false
+	}
+
+	Walk(root, func(a *Node) bool {
+		if a.IsFile() {
+			return false
+		}
+		h, ok := rarest[a]
+		if a == root || !ok || len(copies[h]) > nearCandidateCopies {
+			return true
+		}
+		need := make(map[hash]int)
+		for _, f := range contentFiles(a) {
+			need[f.Hash]++
+		}
+		contained := func(b *Node) bool {
+			for h, count := range need {
+				if copiesUnder(h, b) < count {
+					return false
+				}
+			}
+			return true
+		}
+		var best *Node
+		for _, f := range copies[h] {
+			if isUnder(f, a) {
+				continue
+			}
+			// the ancestors of the copy only grow, so the first container is the smallest on the way up.
+			for b := f.Parent; b != nil; b = b.Parent {
+				if isUnder(a, b) || (best != nil && counts[b] >= counts[best]) {
+					break
+				}
+				// a directory with fewer files cannot contain the directory, but its ancestors can.
+				if counts[b] < counts[a] {
+					continue
+				}
+				// the ancestors of a container that overlaps a reported directory overlap it too.
+				if b.Hash == a.Hash || overlapsReported(b) {
+					break
+				}
+				if contained(b) {
+					if counts[b] > counts[a] {
+						best = b
+					}
+					break
+				}
+			}
+		}
+		if best == nil {
+			return true
+		}
+		reported[a] = true
+		for p := a.Parent; p != nil; p = p.Parent {
+			reportedBelow[p]++
+		}
+		onContained(Containment{Node: a, Container: best, ExtraCount: counts[best] - counts[a]})
+		return false
+	})
+}
+
+// contentFiles returns the files under the node that are not tolerated.
+func contentFiles(root *Node) []*Node {
+	files := []*Node{}
+	WalkAll(root, func(n *Node) {
+		if n.IsFile() && !n.Tolerated {
+			files = append(files, n)
+		}
+	})
+	return files
+}
+
+// containedIn returns true if each of the files has a copy in the container, and returns the files of the container
+// without a copy in the files.
+func containedIn(files, container []*Node) ([]*Node, bool) {
+	counts := make(map[hash]int)
+	for _, f := range container {
+		counts[f.Hash]++
+	}
+	for _, f := range files {
+		if counts[f.Hash] == 0 {
+			return nil, false
+		}
+		counts[f.Hash]--
+	}
+	extra := []*Node{}
+	for _, f := range container {
+		if counts[f.Hash] > 0 {
+			counts[f.Hash]--
+			extra = append(extra, f)
+		}
+	}
+	return extra, true
+}
+
+// isUnder returns true if the node is the ancestor or the node itself.
+func isUnder(n, ancestor *Node) bool {
+	for p := n; p != nil; p = p.Parent {
+		if p == ancestor {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,711 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"greasytoad/listing"
+	"greasytoad/log"
+	"io"
+	"strings"
+)
+
+// ExternalOpts are the options of FindSimilaritiesExternal.
+type ExternalOpts struct {
+	LoadOpts
+	SimilarityOpts
+	// TempDir is the directory of the temporary files, the default directory for temporary files if empty.
+	TempDir string
+	// RunSize is about the number of bytes of records sorted in memory at once, DefaultRunSize if not set.
+	RunSize int
+}
+
+// DefaultRunSize is the default ExternalOpts.RunSize.
+const DefaultRunSize = 64 << 20
+
+// FindSimilaritiesExternal reports the same groups as FindSimilarities does for the tree of the listings, without
+// loading the tree into memory. The files are sorted on disk by path to derive the hashes of the directories bottom-up,
+// and by hash to group the duplicates. onGroup gets the paths of the nodes, like Node.FullPath, in the order of
+// FindSimilarities. Several listings are merged under roots named like in the analyze command.
+func FindSimilaritiesExternal(inputs []io.Reader, opts ExternalOpts, onGroup func(SimilarityType, []string)) error {
+	if opts.RunSize == 0 {
+		opts.RunSize = DefaultRunSize
+	}
+	rootNames, err := RootNames(len(inputs))
+	if err != nil {
+		return err
+	}
+	x := &external{opts: opts, nameKey: nameKeyFunc(opts.LoadOpts), merged: len(inputs) > 1}
+	defer x.close()
+	x.ignored = ignoredNames(opts.LoadOpts, x.nameKey)
+	if x.tolerated, err = newTolerance(opts.LoadOpts, x.nameKey); err != nil {
+		return err
+	}
+
+	entries := x.newSorter()
+	var first *listing.Header
+	for i, in := range inputs {
+		header, err := x.readEntries(in, rootNames[i], entries)
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			first = header
+		} else if header != nil {
+			if err := listing.CheckCompatible(*first, *header); err != nil {
+				if !opts.AllowIncompatible {
+					return fmt.Errorf("incompatible listings: %v", err)
+				}
+				log.Printf("WARNING: incompatible listings: %v", err)
+			}
+		}
+	}
+
+	byHash := x.newSorter()
+	if err := x.buildNodes(entries, byHash); err != nil {
+		return err
+	}
+	bySeq, members := x.newSorter(), x.newSorter()
+	if err := x.groupNodes(byHash, bySeq, members); err != nil {
+		return err
+	}
+	byPath := x.newSorter()
+	if err := x.classifyNodes(bySeq, byPath); err != nil {
+		return err
+	}
+	requests, lines := x.newSorter(), x.newSorter()
+	if err := x.walkNodes(byPath, requests, lines); err != nil {
+		return err
+	}
+	if err := x.joinGroups(requests, members, lines); err != nil {
+		return err
+	}
+	return lines.each(func(record []byte) error {
+		similarity, paths := decodeLine(recordPayload(record))
+		if x.opts.Roots == AllRoots || x.opts.Roots.keep(similarity, CountPathsByRoot(paths, x.merged)) {
+			onGroup(similarity, paths)
+		}
+		return nil
+	})
+}
+
+// RootNames returns the names of the roots of several listings analyzed together, the root of a single listing has no
+// name.
+func RootNames(count int) ([]string, error) {
+	if count == 1 {
+		return []string{""}, nil
+	}
+	letters := "abcdefghijklmnopqrstuvxyz"
+	if count > len(letters) {
+		return nil, fmt.Errorf("input too large, max %d entries", len(letters))
+	}
+	names := make([]string, count)
+	for i := range names {
+		names[i] = letters[i : i+1]
+	}
+	return names, nil
+}
+
+type external struct {
+	opts    ExternalOpts
+	nameKey func(string) string
+	ignored map[string]bool
+	// tolerated tells the files skipped by the hashes of the directories.
+	tolerated tolerance
+	// merged is true for several listings analyzed together.
+	merged bool
+	// sorters are closed at the end, so no temporary files are left after an error.
+	sorters []*recordSorter
+}
+
+// CountPathsByRoot returns the number of the paths under each root like CountByRoot, for the paths of
+// FindSimilaritiesExternal. The paths of merged listings start with the name of the root.
+func CountPathsByRoot(paths []string, merged bool) []RootCount {
+	roots := make([]string, len(paths))
+	for i, p := range paths {
+		if merged {
+			roots[i], _, _ = strings.Cut(p, "/")
+		}
+	}
+	return countRoots(roots)
+}
+
+func (x *external) newSorter() *recordSorter {
+	s := newRecordSorter(x.opts.TempDir, x.opts.RunSize)
+	x.sorters = append(x.sorters, s)
+	return s
+}
+
+// close removes the temporary files of all the sorters.
+func (x *external) close() {
+	for _, s := range x.sorters {
+		s.close()
+	}
+}
+
+const (
+	extDir uint8 = 1 << iota
+	// extSuppressed is set for the nodes with a child of the same hash, which are not indexed by hash, like in
+	// indexNodesByHashOptimized.
+	extSuppressed
+	// extDuplicated is set for the nodes whose hash has more than one indexed node.
+	extDuplicated
+	// extUnknownSize is set for the files without size that could not be stat-ed.
+	extUnknownSize
+)
+
+// extNode is a file or a directory in a record of the external mode.
+type extNode struct {
+	// key is the path components separated with zero bytes, so sorting by key sorts the nodes in the order of Walk.
+	key string
+	// path is the path components separated with slashes, in the original spelling.
+	path       string
+	seq        uint64
+	depth      int
+	flags      uint8
+	similarity SimilarityType
+	hash       hash
+	size       int64
+	allocated  int64
+	fileCount  int64
+	// fileHash is the hash of the file as in the listing, it is set only for the entries of the listing.
+	fileHash string
+}
+
+func (n *extNode) isDir() bool {
+	return n.flags&extDir != 0
+}
+
+func (n *extNode) isEmptyDir() bool {
+	return n.isDir() && n.fileCount == 0
+}
+
+// isIndexed returns true for the nodes that are in the groups of nodes by hash.
+func (n *extNode) isIndexed() bool {
+	return !n.isEmptyDir() && n.flags&extSuppressed == 0
+}
+
+// fullPath returns the path of the node like Node.FullPath. The roots of merged listings have no parent, so their
+// paths do not start with a slash.
+func (x *external) fullPath(n *extNode) string {
+	path := n.path
+	if n.path == "" || !x.merged {
+		path = "/" + path
+	}
+	if n.isDir() && n.path != "" {
+		path += "/"
+	}
+	return path
+}
+
+func (n *extNode) encode() []byte {
+	b := make([]byte, 0, 64+len(n.key)+len(n.path)+len(n.fileHash))
+	b = appendString(b, n.key)
+	b = appendString(b, n.path)
+	b = binary.AppendUvarint(b, n.seq)
+	b = binary.AppendUvarint(b, uint64(n.depth))
+	b = append(b, n.flags, byte(n.similarity))
+	b = append(b, n.hash[:]...)
+	b = binary.AppendVarint(b, n.size)
+	b = binary.AppendVarint(b, n.allocated)
+	b = binary.AppendVarint(b, n.fileCount)
+	return appendString(b, n.fileHash)
+}
+
+func decodeNode(b []byte) extNode {
+	n := extNode{}
+	n.key, b = readString(b)
+	n.path, b = readString(b)
+	var v uint64
+	n.seq, b = readUvarint(b)
+	v, b = readUvarint(b)
+	n.depth = int(v)
+	n.flags, n.similarity, b = b[0], SimilarityType(b[1]), b[2:]
+	b = b[copy(n.hash[:], b):]
+	n.size, b = readVarint(b)
+	n.allocated, b = readVarint(b)
+	n.fileCount, b = readVarint(b)
+	n.fileHash, _ = readString(b)
+	return n
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte) {
+	length, n := binary.Uvarint(b)
+	return string(b[n : n+int(length)]), b[n+int(length):]
+}
+
+func readUvarint(b []byte) (uint64, []byte) {
+	v, n := binary.Uvarint(b)
+	return v, b[n:]
+}
+
+func readVarint(b []byte) (int64, []byte) {
+	v, n := binary.Varint(b)
+	return v, b[n:]
+}
+
+func hashKey(h hash, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(h[:], seq)
+}
+
+func seqKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// readEntries adds the entries of the listing to the sorter by path. It returns the first header of the listing.
+func (x *external) readEntries(data io.Reader, rootName string, entries *recordSorter) (*listing.Header, error) {
+	reader, err := openListing(data, x.opts.LoadOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	unknownSizeCount := 0
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		if rootName != "" {
+			names = append(names, rootName)
+		}
+		ignore := false
+		for _, name := range strings.Split(entry.Path, "/") {
+			if x.ignored[x.nameKey(name)] {
+				log.Debugf("ignore %s because of %s", entry.Path, name)
+				ignore = true
+				break
+			}
+			if name != "" && name != "." {
+				names = append(names, name)
+			}
+		}
+		if ignore || (len(names) == 0 && !entry.Dir) {
+			continue
+		}
+		keys := make([]string, len(names))
+		for i, name := range names {
+			keys[i] = x.nameKey(name)
+		}
+		n := extNode{
+			key:       strings.Join(keys, "\x00"),
+			path:      strings.Join(names, "/"),
+			size:      entry.Size,
+			allocated: entry.Allocated,
+			fileHash:  entry.Hash,
+		}
+		if entry.Dir {
+			n.flags = extDir
+		} else if entry.Size == listing.UnknownSize {
+			unknownSizeCount++
+			var sizeKnown bool
+			if n.size, n.allocated, sizeKnown = statSize(x.opts.StatRoot, entry.Path); !sizeKnown {
+				n.flags |= extUnknownSize
+			}
+		}
+		if err := entries.add(newRecord([]byte(n.key), n.encode())); err != nil {
+			return nil, err
+		}
+	}
+	return reader.finish(unknownSizeCount)
+}
+
+// extFrame is a directory whose children are being read.
+type extFrame struct {
+	node extNode
+	keys []string
+	// children are the hashes of the children that are not empty directories, in the order of names.
+	children []hash
+	// kept are the hashes of the children that are not tolerated either, see tolerance.
+	kept []hash
+	// structure holds all the children for the structure hash.
+	structure []structureChild
+}
+
+// buildNodes reads the entries sorted by path, and adds the files and the directories to the sorter by hash, the
+// directories after their children. Only the directories on the path to the current entry are kept in memory.
+func (x *external) buildNodes(entries *recordSorter, byHash *recordSorter) error {
+	seq := uint64(0)
+	emit := func(n *extNode) error {
+		n.seq = seq
+		seq++
+		return byHash.add(newRecord(hashKey(n.hash, n.seq), n.encode()))
+	}
+	stack := []*extFrame{{node: extNode{flags: extDir}}}
+	closeFrame := func() error {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := &frame.node
+		tolerated := n.fileCount > 0 && len(frame.kept) == 0
+		kept := frame.kept
+		if len(kept) == 0 {
+			// a directory of only tolerated files is compared by all of them, like in calculateHash.
+			kept = frame.children
+		}
+		// the root of a listing is not a wrapper, like in updateTree.
+		listingRoot := len(stack) == 0 || (x.merged && len(stack) == 1)
+		content, structure := hashOfChildren(kept, !x.opts.DistinctWrappers || listingRoot), structureHash(frame.structure)
+		// children are the hashes of the children of the kind that drives the classification.
+		children := frame.children
+		n.hash = content
+		if x.opts.Hash == ByStructure {
+			children = make([]hash, len(frame.structure))
+			for i, ch := range frame.structure {
+				children[i] = ch.hash
+			}
+			n.hash = structure
+		}
+		if x.merged && len(stack) == 0 {
+			// the root of merged listings has no hash, see mergeNodesIntoSingleTree of the analyze command.
+			n.hash = hash{}
+		}
+		for _, h := range children {
+			if h == n.hash {
+				n.flags |= extSuppressed
+				break
+			}
+		}
+		if err := emit(n); err != nil {
+			return err
+		}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			parent.node.size += n.size
+			parent.node.allocated += n.allocated
+			parent.node.fileCount += n.fileCount
+			if !n.isEmptyDir() {
+				parent.children = append(parent.children, content)
+				if !tolerated {
+					parent.kept = append(parent.kept, content)
+				}
+			}
+			parent.structure = append(parent.structure, structureChild{frame.keys[len(frame.keys)-1], DirNode, structure})
+		}
+		return nil
+	}
+	addFile := func(n extNode, keys []string) error {
+		n.depth = len(keys)
+		n.hash = calculateHashFromString(n.fileHash)
+		n.fileHash = ""
+		n.fileCount = 1
+		if err := emit(&n); err != nil {
+			return err
+		}
+		parent := stack[len(stack)-1]
+		parent.node.size += n.size
+		parent.node.allocated += n.allocated
+		parent.node.fileCount++
+		parent.children = append(parent.children, n.hash)
+		if !x.tolerated.file(keys[len(keys)-1], n.size, n.flags&extUnknownSize == 0) {
+			parent.kept = append(parent.kept, n.hash)
+		}
+		// the structure hash of a file is its content hash.
+		parent.structure = append(parent.structure, structureChild{keys[len(keys)-1], FileNode, n.hash})
+		return nil
+	}
+	// addEntry closes the directories that are not on the path of the entry, and opens the missing ones.
+	addEntry := func(n extNode) error {
+		keys := strings.Split(n.key, "\x00")
+		names := strings.Split(n.path, "/")
+		if n.key == "" {
+			keys, names = nil, nil
+		}
+		dirKeys := keys
+		if !n.isDir() {
+			dirKeys = keys[:len(keys)-1]
+		}
+		for len(stack) > 1 && !isPrefix(stack[len(stack)-1].keys, dirKeys) {
+			if err := closeFrame(); err != nil {
+				return err
+			}
+		}
+		for depth := len(stack); depth <= len(dirKeys); depth++ {
+			stack = append(stack, &extFrame{
+				node: extNode{
+					key:   strings.Join(dirKeys[:depth], "\x00"),
+					path:  strings.Join(names[:depth], "/"),
+					depth: depth,
+					flags: extDir,
+				},
+				keys: dirKeys[:depth],
+			})
+		}
+		if n.isDir() {
+			return nil
+		}
+		return addFile(n, keys)
+	}
+
+	// entries with the same path replace each other, the last one is kept.
+	var pending *extNode
+	err := entries.each(func(record []byte) error {
+		n := decodeNode(recordPayload(record))
+		if pending != nil && pending.key != n.key {
+			if err := addEntry(*pending); err != nil {
+				return err
+			}
+		}
+		pending = &n
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		if err := addEntry(*pending); err != nil {
+			return err
+		}
+	}
+	for len(stack) > 0 {
+		if err := closeFrame(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isPrefix(prefix, keys []string) bool {
+	if len(prefix) > len(keys) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// groupNodes reads the nodes sorted by hash and flags the duplicated ones. It adds the nodes to the sorter by the order
+// of buildNodes, and the indexed nodes to the sorter of the members of the groups by hash.
+func (x *external) groupNodes(byHash *recordSorter, bySeq *recordSorter, members *recordSorter) error {
+	group := []extNode{}
+	flushGroup := func() error {
+		indexed := 0
+		for i := range group {
+			if group[i].isIndexed() {
+				indexed++
+			}
+		}
+		for i := range group {
+			n := &group[i]
+			if indexed > 1 {
+				n.flags |= extDuplicated
+			}
+			if n.isIndexed() {
+				key := append(n.hash[:], n.key...)
+				if err := members.add(newRecord(key, n.encode())); err != nil {
+					return err
+				}
+			}
+			if err := bySeq.add(newRecord(seqKey(n.seq), n.encode())); err != nil {
+				return err
+			}
+		}
+		group = group[:0]
+		return nil
+	}
+	err := byHash.each(func(record []byte) error {
+		n := decodeNode(recordPayload(record))
+		if len(group) > 0 && group[0].hash != n.hash {
+			if err := flushGroup(); err != nil {
+				return err
+			}
+		}
+		group = append(group, n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flushGroup()
+}
+
+// childSimilarities sums up the similarities of the children of a directory, for the rules of getSimilarityMap.
+type childSimilarities struct {
+	allDuplicateOrEmpty       bool
+	allUniqueOrEmpty          bool
+	allUniqueOrPartialOrEmpty bool
+	someDuplicate             bool
+	someUniqueOrPartial       bool
+	someUnknown               bool
+}
+
+func newChildSimilarities() childSimilarities {
+	return childSimilarities{allDuplicateOrEmpty: true, allUniqueOrEmpty: true, allUniqueOrPartialOrEmpty: true}
+}
+
+func (c *childSimilarities) add(st SimilarityType) {
+	duplicate := st == FullDuplicate || st == WeakDuplicate
+	uniqueOrPartial := st == Unique || st == PartiallyUnique
+	empty := st == Empty
+	c.allDuplicateOrEmpty = c.allDuplicateOrEmpty && (duplicate || empty)
+	c.allUniqueOrEmpty = c.allUniqueOrEmpty && (st == Unique || empty)
+	c.allUniqueOrPartialOrEmpty = c.allUniqueOrPartialOrEmpty && (uniqueOrPartial || empty)
+	c.someDuplicate = c.someDuplicate || duplicate
+	c.someUniqueOrPartial = c.someUniqueOrPartial || uniqueOrPartial
+	c.someUnknown = c.someUnknown || st == Unknown
+}
+
+func (c *childSimilarities) similarity() SimilarityType {
+	switch {
+	case c.allDuplicateOrEmpty:
+		return WeakDuplicate
+	case c.allUniqueOrEmpty:
+		return Unique
+	case c.allUniqueOrPartialOrEmpty:
+		return PartiallyUnique
+	case c.someDuplicate && c.someUniqueOrPartial && !c.someUnknown:
+		return PartiallyUnique
+	default:
+		return Unknown
+	}
+}
+
+// classifyNodes reads the nodes with the children before the parents, sets the similarity of the nodes like
+// getSimilarityMap, and adds them to the sorter by path.
+func (x *external) classifyNodes(bySeq *recordSorter, byPath *recordSorter) error {
+	// children holds the similarities of the children of the directories at each depth.
+	children := []childSimilarities{}
+	return bySeq.each(func(record []byte) error {
+		n := decodeNode(recordPayload(record))
+		for len(children) <= n.depth+1 {
+			children = append(children, newChildSimilarities())
+		}
+		switch {
+		case n.isEmptyDir():
+			n.similarity = Empty
+		case n.flags&extDuplicated != 0:
+			n.similarity = FullDuplicate
+		case !n.isDir():
+			n.similarity = Unique
+		default:
+			n.similarity = children[n.depth+1].similarity()
+		}
+		if n.isDir() {
+			children[n.depth+1] = newChildSimilarities()
+		}
+		children[n.depth].add(n.similarity)
+		return byPath.add(newRecord([]byte(n.key), n.encode()))
+	})
+}
+
+// walkNodes reads the nodes in the order of Walk, and follows the rules of FindSimilarities when to descend. The
+// empty directories are added to the output lines directly, the other nodes are added to the sorter of requests of
+// groups by hash.
+func (x *external) walkNodes(byPath *recordSorter, requests *recordSorter, lines *recordSorter) error {
+	walkSeq := uint64(0)
+	// skipBelow is the depth of a node whose descendants are not walked, or -1.
+	skipBelow := -1
+	return byPath.each(func(record []byte) error {
+		n := decodeNode(recordPayload(record))
+		if skipBelow >= 0 {
+			if n.depth > skipBelow {
+				return nil
+			}
+			skipBelow = -1
+		}
+		n.seq = walkSeq
+		walkSeq++
+		var err error
+		if n.similarity == Empty {
+			err = lines.add(newRecord(seqKey(n.seq), encodeLine(Empty, []string{x.fullPath(&n)})))
+		} else {
+			err = requests.add(newRecord(hashKey(n.hash, n.seq), n.encode()))
+		}
+		if err != nil {
+			return err
+		}
+		descend := true
+		switch n.similarity {
+		case FullDuplicate:
+			descend = n.flags&extSuppressed != 0
+		case Unique, Empty:
+			descend = false
+		}
+		if !descend {
+			skipBelow = n.depth
+		}
+		return nil
+	})
+}
+
+// joinGroups adds the output line of each request with the paths of the group of its hash. A node that is in a group
+// reported before is not reported again, like with the alreadyReported nodes of FindSimilarities.
+func (x *external) joinGroups(requests *recordSorter, members *recordSorter, lines *recordSorter) error {
+	membersIt, err := members.iterate()
+	if err != nil {
+		return err
+	}
+	defer membersIt.close()
+	var member *extNode
+	nextMember := func() error {
+		record, err := membersIt.next()
+		if err == io.EOF {
+			member = nil
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := decodeNode(recordPayload(record))
+		member = &n
+		return nil
+	}
+	if err := nextMember(); err != nil {
+		return err
+	}
+
+	var groupHash hash
+	var paths []string
+	reported := false
+	return requests.each(func(record []byte) error {
+		n := decodeNode(recordPayload(record))
+		if paths == nil || n.hash != groupHash {
+			groupHash, paths, reported = n.hash, []string{}, false
+			for member != nil && bytes.Compare(member.hash[:], n.hash[:]) < 0 {
+				if err := nextMember(); err != nil {
+					return err
+				}
+			}
+			for member != nil && member.hash == n.hash {
+				paths = append(paths, x.fullPath(member))
+				if err := nextMember(); err != nil {
+					return err
+				}
+			}
+		}
+		if reported && n.isIndexed() {
+			return nil
+		}
+		reported = true
+		return lines.add(newRecord(seqKey(n.seq), encodeLine(n.similarity, paths)))
+	})
+}
+
+func encodeLine(similarity SimilarityType, paths []string) []byte {
+	b := []byte{byte(similarity)}
+	b = binary.AppendUvarint(b, uint64(len(paths)))
+	for _, p := range paths {
+		b = appendString(b, p)
+	}
+	return b
+}
+
+func decodeLine(b []byte) (SimilarityType, []string) {
+	similarity := SimilarityType(b[0])
+	count, b := readUvarint(b[1:])
+	paths := make([]string, count)
+	for i := range paths {
+		paths[i], b = readString(b)
+	}
+	return similarity, paths
+}
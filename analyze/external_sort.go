@@ -0,0 +1,344 @@
+package analyze
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// recordSorter sorts records that do not fit in memory. A record starts with its sort key, see newRecord. The records
+// are sorted in runs of about runSize bytes, which are written to temporary files and merged. Records with equal keys
+// keep the order in which they were added.
+type recordSorter struct {
+	dir     string
+	runSize int
+	records [][]byte
+	size    int
+	// runs are the paths of the sorted runs, in the order they were written. The files are open only while merged.
+	runs []string
+}
+
+func newRecordSorter(dir string, runSize int) *recordSorter {
+	return &recordSorter{dir: dir, runSize: runSize}
+}
+
+// newRecord returns a record with the sort key and the payload.
+func newRecord(key, payload []byte) []byte {
+	record := make([]byte, 0, binary.MaxVarintLen64+len(key)+len(payload))
+	record = binary.AppendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	return append(record, payload...)
+}
+
+func recordKey(record []byte) []byte {
+	length, n := binary.Uvarint(record)
+	return record[n : n+int(length)]
+}
+
+func recordPayload(record []byte) []byte {
+	length, n := binary.Uvarint(record)
+	return record[n+int(length):]
+}
+
+func lessRecord(a, b []byte) bool {
+	return bytes.Compare(recordKey(a), recordKey(b)) < 0
+}
+
+// add takes the ownership of the record.
+func (s *recordSorter) add(record []byte) error {
+	s.records = append(s.records, record)
+	s.size += len(record)
+	if s.size >= s.runSize {
+		return s.writeRun()
+	}
+	return nil
+}
+
+func (s *recordSorter) sortRecords() {
+	sort.SliceStable(s.records, func(i, j int) bool {
+		return lessRecord(s.records[i], s.records[j])
+	})
+}
+
+func (s *recordSorter) writeRun() error {
+	s.sortRecords()
+	f, err := os.CreateTemp(s.dir, "analyze-run-")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, record := range s.records {
+		if err = writeRecord(w, record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	s.runs = append(s.runs, f.Name())
+	s.records, s.size = nil, 0
+	return nil
+}
+
+// each calls onRecord with the records in the sorted order, and removes the temporary files. The record must not be
+// kept after the call.
+func (s *recordSorter) each(onRecord func([]byte) error) error {
+	it, err := s.iterate()
+	if err != nil {
+		return err
+	}
+	defer it.close()
+	for {
+		record, err := it.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := onRecord(record); err != nil {
+			return err
+		}
+	}
+}
+
+// iterate returns an iterator over the records in the sorted order. Closing the iterator removes the temporary files.
+func (s *recordSorter) iterate() (*recordIterator, error) {
+	it := &recordIterator{sorter: s}
+	if len(s.runs) == 0 {
+		s.sortRecords()
+		it.records = s.records
+		return it, nil
+	}
+	if len(s.records) > 0 {
+		if err := s.writeRun(); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	// the runs are merged in passes, so at most maxMergeRuns files are open at once.
+	for len(s.runs) > maxMergeRuns {
+		if err := s.mergePass(); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	merger, err := openRuns(s.runs)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	it.merger = merger
+	return it, nil
+}
+
+// maxMergeRuns is the most runs merged at once, so the open files stay well below the usual limit of 1024 also with
+// several sorters open.
+const maxMergeRuns = 128
+
+// mergePass merges each maxMergeRuns consecutive runs into a run. The runs stay in the order of adding, so the records
+// with equal keys keep their order.
+func (s *recordSorter) mergePass() error {
+	merged := []string{}
+	for len(s.runs) > 0 {
+		count := min(maxMergeRuns, len(s.runs))
+		name, err := s.mergeRuns(s.runs[:count])
+		if err != nil {
+			s.runs = append(merged, s.runs...)
+			return err
+		}
+		for _, path := range s.runs[:count] {
+			os.Remove(path)
+		}
+		merged = append(merged, name)
+		s.runs = s.runs[count:]
+	}
+	s.runs = merged
+	return nil
+}
+
+// mergeRuns writes the records of the runs to a new run, and returns its path.
+func (s *recordSorter) mergeRuns(paths []string) (string, error) {
+	merger, err := openRuns(paths)
+	if err != nil {
+		return "", err
+	}
+	defer merger.close()
+	f, err := os.CreateTemp(s.dir, "analyze-run-")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	for {
+		var record []byte
+		if record, err = merger.next(); err != nil {
+			break
+		}
+		if err = writeRecord(w, record); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// recordIterator returns the sorted records from memory, or merges the sorted runs.
+type recordIterator struct {
+	sorter  *recordSorter
+	records [][]byte
+	merger  *runMerger
+}
+
+// next returns the next record, or io.EOF. The record is valid until the next call.
+func (it *recordIterator) next() ([]byte, error) {
+	if it.merger != nil {
+		return it.merger.next()
+	}
+	if len(it.records) == 0 {
+		return nil, io.EOF
+	}
+	record := it.records[0]
+	it.records = it.records[1:]
+	return record, nil
+}
+
+func (it *recordIterator) close() {
+	if it.merger != nil {
+		it.merger.close()
+	}
+	it.sorter.close()
+}
+
+func (s *recordSorter) close() {
+	for _, path := range s.runs {
+		os.Remove(path)
+	}
+	s.runs, s.records = nil, nil
+}
+
+// runMerger merges the records of open runs.
+type runMerger struct {
+	files []*os.File
+	runs  runHeap
+	// current is the run of the last returned record, it is advanced on the next call.
+	current *runReader
+}
+
+// openRuns opens the runs for merging, the index of each run is its position in the paths.
+func openRuns(paths []string) (*runMerger, error) {
+	m := &runMerger{}
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.files = append(m.files, f)
+		r := &runReader{index: i, reader: bufio.NewReader(f)}
+		if ok, err := r.next(); err != nil {
+			m.close()
+			return nil, err
+		} else if ok {
+			m.runs = append(m.runs, r)
+		}
+	}
+	heap.Init(&m.runs)
+	return m, nil
+}
+
+// next returns the next record, or io.EOF. The record is valid until the next call.
+func (m *runMerger) next() ([]byte, error) {
+	if m.current != nil {
+		if ok, err := m.current.next(); err != nil {
+			return nil, err
+		} else if ok {
+			heap.Fix(&m.runs, 0)
+		} else {
+			heap.Pop(&m.runs)
+		}
+		m.current = nil
+	}
+	if len(m.runs) == 0 {
+		return nil, io.EOF
+	}
+	m.current = m.runs[0]
+	return m.current.record, nil
+}
+
+func (m *runMerger) close() {
+	for _, f := range m.files {
+		f.Close()
+	}
+	m.files = nil
+}
+
+func writeRecord(w *bufio.Writer, record []byte) error {
+	var length [binary.MaxVarintLen64]byte
+	if _, err := w.Write(length[:binary.PutUvarint(length[:], uint64(len(record)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
+}
+
+// runReader reads the records of a sorted run.
+type runReader struct {
+	index  int
+	reader *bufio.Reader
+	record []byte
+}
+
+func (r *runReader) next() (bool, error) {
+	length, err := binary.ReadUvarint(r.reader)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if cap(r.record) < int(length) {
+		r.record = make([]byte, length)
+	}
+	r.record = r.record[:length]
+	_, err = io.ReadFull(r.reader, r.record)
+	return err == nil, err
+}
+
+// runHeap merges the runs. The runs with equal records are ordered by index, so the merge keeps the order of adding.
+type runHeap []*runReader
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if c := bytes.Compare(recordKey(h[i].record), recordKey(h[j].record)); c != 0 {
+		return c < 0
+	}
+	return h[i].index < h[j].index
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
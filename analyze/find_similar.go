@@ -28,15 +28,95 @@ func (m similarityMap) get(node *Node) similarityMapValue {
 	}
 }
 
+// SimilarityOpts are the options of FindSimilaritiesOpts.
+type SimilarityOpts struct {
+	// Hash is the hash of the nodes that are compared.
+	Hash HashKind
+	// Roots selects the groups of duplicates by the roots of their nodes.
+	Roots RootFilter
+}
+
+// RootFilter selects the groups of duplicates by the roots of several listings analyzed together, see Node.Root.
+type RootFilter uint8
+
+const (
+	// AllRoots reports all the groups. It is a zero value.
+	AllRoots RootFilter = iota
+	// CrossRoots reports only the duplicates with nodes under at least two roots, e.g. what in a backup already
+	// exists in the master copy.
+	CrossRoots
+	// IntraRoot reports only the duplicates with all the nodes under a single root, the complement of CrossRoots.
+	IntraRoot
+)
+
+// keep returns true if the group with the given number of nodes under each root is reported.
+func (f RootFilter) keep(st SimilarityType, counts []RootCount) bool {
+	if f == AllRoots {
+		return true
+	}
+	if st != FullDuplicate {
+		return false
+	}
+	if f == CrossRoots {
+		return len(counts) > 1
+	}
+	return len(counts) == 1
+}
+
+// RootCount is the number of the nodes of a group under a root.
+type RootCount struct {
+	Root  string
+	Count int
+}
+
+// CountByRoot returns the number of the nodes under each root, in the order of the first node under each root.
+func CountByRoot(nodes []*Node) []RootCount {
+	roots := make([]string, len(nodes))
+	for i, n := range nodes {
+		roots[i] = n.Root().Name
+	}
+	return countRoots(roots)
+}
+
+func countRoots(roots []string) []RootCount {
+	counts := []RootCount{}
+	index := make(map[string]int)
+	for _, root := range roots {
+		i, ok := index[root]
+		if !ok {
+			i = len(counts)
+			index[root] = i
+			counts = append(counts, RootCount{Root: root})
+		}
+		counts[i].Count++
+	}
+	return counts
+}
+
 func FindSimilarities(root *Node, onNodes func(SimilarityType, []*Node)) {
-	similarityMap := getSimilarityMap(root)
+	FindSimilaritiesOpts(root, SimilarityOpts{}, onNodes)
+}
+
+func FindSimilaritiesOpts(root *Node, opts SimilarityOpts, onNodes func(SimilarityType, []*Node)) {
+	similarityMap := getSimilarityMap(root, opts.Hash)
+	if opts.Roots != AllRoots {
+		// the filtered out groups are still walked as reported, so the output is a subset of the unfiltered one.
+		report := onNodes
+		onNodes = func(st SimilarityType, nodes []*Node) {
+			if opts.Roots.keep(st, CountByRoot(nodes)) {
+				report(st, nodes)
+			}
+		}
+	}
 
 	// alreadyReported holds nodes that appeared on in the output. This is to skip analysing nodes that already appeared as duplicate
 	// of another node. This results in less noise on the output.
 	alreadyReported := make(map[*Node]bool)
 
 	Walk(root, func(currentNode *Node) bool {
-		log.Debugf("FindSimilarities: now walk %s", currentNode.FullPath())
+		if log.DebugEnabled {
+			log.Debugf("FindSimilarities: now walk %s", currentNode.FullPath())
+		}
 
 		similarity := similarityMap.get(currentNode)
 
@@ -50,18 +130,21 @@ func FindSimilarities(root *Node, onNodes func(SimilarityType, []*Node)) {
 		updateNodeSet(alreadyReported, similarity.sameHash...)
 
 		if similarity.similarityType == FullDuplicate {
-			if someChildren(currentNode, condSameHash(currentNode.Hash)) {
+			if someChildren(currentNode, condSameHash(currentNode.HashOf(opts.Hash), opts.Hash)) {
 				return true
 			} else {
 				// If current node is a full duplicate of other node, and there is no child node with similar hash, then do not
 				// descend. It won't bring any useful information.
-				log.Debugf("FindSimilarities: FullDuplicate, do not descend %s", currentNode.FullPath())
+				if log.DebugEnabled {
+					log.Debugf("FindSimilarities: FullDuplicate, do not descend %s", currentNode.FullPath())
+				}
 				return false
 			}
 		}
 
-		if similarity.similarityType == Unique {
-			// No point in showing nodes that are children of unique node, they are unique as well.
+		if similarity.similarityType == Unique || similarity.similarityType == Empty {
+			// No point in showing nodes that are children of unique node, they are unique as well. The same for
+			// empty directories.
 			return false
 		}
 
@@ -69,26 +152,31 @@ func FindSimilarities(root *Node, onNodes func(SimilarityType, []*Node)) {
 	})
 }
 
-func indexNodesByHashOptimized(root *Node) map[hash][]*Node {
+func indexNodesByHashOptimized(root *Node, kind HashKind) map[hash][]*Node {
 	// if there is a directory structure a/b/f then a, b and f will have the same hash. Here we report only one of those three,
 	// otherwise they would show up as duplicates of each other.
 	m := make(map[hash][]*Node)
 	WalkAll(root, func(n *Node) {
-		hasSameHash := func(d *Node) bool {
-			return n.Hash == d.Hash
+		if n.IsEmptyDir() {
+			// empty directories do not have content, so they are not duplicates of each other.
+			return
 		}
+		hasSameHash := condSameHash(n.HashOf(kind), kind)
 		if ch := n.FindChild(hasSameHash); ch != nil {
 			// Do not index node if the there is a node with the same hash. This results in omitting parent nodes that have
 			// duplicated children, which results in less noise on output.
-			log.Debugf("indexNodesByHashOptimized: ignore '%s' because of a duplicated child '%s'", n.FullPath(), ch.Name)
+			if log.DebugEnabled {
+				log.Debugf("indexNodesByHashOptimized: ignore '%s' because of a duplicated child '%s'", n.FullPath(), ch.Name)
+			}
 			return
 		}
-		nodes, ok := m[n.Hash]
+		h := n.HashOf(kind)
+		nodes, ok := m[h]
 		if !ok {
 			nodes = []*Node{}
-			m[n.Hash] = nodes
+			m[h] = nodes
 		}
-		m[n.Hash] = append(nodes, n)
+		m[h] = append(nodes, n)
 	})
 	return m
 }
@@ -100,10 +188,10 @@ func updateNodeSet(m map[*Node]bool, nodes ...*Node) {
 	}
 }
 
-func getSimilarityMap(root *Node) similarityMap {
+func getSimilarityMap(root *Node, kind HashKind) similarityMap {
 	similarityMap := make(similarityMap)
 
-	nodesByHash := indexNodesByHashOptimized(root)
+	nodesByHash := indexNodesByHashOptimized(root, kind)
 
 	var updateSimilarityRec func(*Node)
 	updateSimilarityRec = func(node *Node) {
@@ -111,8 +199,12 @@ func getSimilarityMap(root *Node) similarityMap {
 			// guarantee that the children have the status already set.
 			updateSimilarityRec(ch)
 		}
-		similarNodes := nodesByHash[node.Hash]
-		if len(nodesByHash[node.Hash]) > 1 {
+		if node.IsEmptyDir() {
+			similarityMap.set(node, Empty, []*Node{node})
+			return
+		}
+		similarNodes := nodesByHash[node.HashOf(kind)]
+		if len(similarNodes) > 1 {
 			// there are nodes with similar hashes, so it is a duplicate.
 			similarityMap.set(node, FullDuplicate, similarNodes)
 			return
@@ -131,6 +223,12 @@ func getSimilarityMap(root *Node) similarityMap {
 		unknown := func(n *Node) bool {
 			return similarityMap.getType(n) == Unknown
 		}
+		// empty directories do not change the similarity of the parent.
+		orEmpty := func(cond func(*Node) bool) func(*Node) bool {
+			return func(n *Node) bool {
+				return cond(n) || n.IsEmptyDir()
+			}
+		}
 
 		if node.IsFile() {
 			// a file without similar nodes is a unique.
@@ -139,15 +237,15 @@ func getSimilarityMap(root *Node) similarityMap {
 		}
 		// all child nodes are full duplicates, but not necessarily in a similar file tree.
 		// this node is marked as weak duplicate.
-		if allChildren(node, fullOrWeakDuplicate) {
+		if allChildren(node, orEmpty(fullOrWeakDuplicate)) {
 			similarityMap.set(node, WeakDuplicate, similarNodes)
 			return
 		}
-		if allChildren(node, unique) {
+		if allChildren(node, orEmpty(unique)) {
 			similarityMap.set(node, Unique, similarNodes)
 			return
 		}
-		if allChildren(node, uniqueOrPartiallyUnique) {
+		if allChildren(node, orEmpty(uniqueOrPartiallyUnique)) {
 			similarityMap.set(node, PartiallyUnique, similarNodes)
 			return
 		}
@@ -157,16 +255,18 @@ func getSimilarityMap(root *Node) similarityMap {
 			similarityMap.set(node, PartiallyUnique, similarNodes)
 			return
 		}
-		log.Debugf("ERROR: unknown similarity type for: %s", node.FullPath())
+		if log.DebugEnabled {
+			log.Debugf("ERROR: unknown similarity type for: %s", node.FullPath())
+		}
 	}
 
 	updateSimilarityRec(root)
 	return similarityMap
 }
 
-func condSameHash(referenceHash hash) func(*Node) bool {
+func condSameHash(referenceHash hash, kind HashKind) func(*Node) bool {
 	return func(n *Node) bool {
-		return n.Hash == referenceHash
+		return n.HashOf(kind) == referenceHash
 	}
 }
 
@@ -176,3 +276,49 @@ func panicAssertf(cond bool, format string, args ...interface{}) {
 		panic(m)
 	}
 }
+
+// ToleratedDifferences returns the tolerated files under the duplicated nodes that are not in all of them at the same
+// path with the same hash, e.g. the desktop.ini files that differ between copies of an album. See LoadOpts.TolerateSize.
+// The paths are compared by the keys of the names, like the names are matched when loading with the options.
+func ToleratedDifferences(nodes []*Node, opts LoadOpts) []*Node {
+	nameKey := nameKeyFunc(opts)
+	type toleratedFile struct {
+		path string
+		hash hash
+	}
+	counts := make(map[toleratedFile]int)
+	// found holds the tolerated files of each node in the order of the walk.
+	found := make([][]*Node, len(nodes))
+	paths := make(map[*Node]toleratedFile)
+	for i, node := range nodes {
+		var collectRec func(n *Node, path string)
+		collectRec = func(n *Node, path string) {
+			if n.IsFile() {
+				if n.Tolerated {
+					f := toleratedFile{path, n.Hash}
+					if _, ok := paths[n]; !ok {
+						counts[f]++
+					}
+					paths[n] = f
+					found[i] = append(found[i], n)
+				}
+				return
+			}
+			for _, ch := range n.Children {
+				collectRec(ch, path+"/"+nameKey(ch.Name))
+			}
+		}
+		if !node.IsFile() {
+			collectRec(node, "")
+		}
+	}
+	differences := []*Node{}
+	for _, files := range found {
+		for _, n := range files {
+			if counts[paths[n]] < len(nodes) {
+				differences = append(differences, n)
+			}
+		}
+	}
+	return differences
+}
@@ -0,0 +1,215 @@
+package analyze
+
+import (
+	"math"
+	"sort"
+)
+
+// NearDuplicateOpts are the options of FindNearDuplicates.
+type NearDuplicateOpts struct {
+	// Threshold is the lowest reported score, from 0 to 1.
+	Threshold float64
+	// ByFileCount weights the files by count instead of by size.
+	ByFileCount bool
+	// SizeMode is the size of the files for weighting by size.
+	SizeMode SizeMode
+}
+
+// NearDuplicate is a pair of directories that share most of their files.
+type NearDuplicate struct {
+	Nodes [2]*Node
+	// Score is the Jaccard similarity of the multisets of the hashes of the files under the directories, weighted by
+	// size or count: the weight of the shared files divided by the weight of all the files of both.
+	Score float64
+	// Differences are the files of each directory that the other does not have.
+	Differences [2][]*Node
+}
+
+// nearCandidateCopies is the most copies of a file used to find the candidate pairs. The files with more copies, e.g.
+// empty files or license texts, are shared by many unrelated directories, so they only count to the score.
+const nearCandidateCopies = 32
+
+// FindNearDuplicates calls onPair with the pairs of directories whose files overlap at least by the threshold, but
+// which are not exact duplicates. The pairs are found through the files with a few copies, and the exact score is
+// calculated for the pairs that can reach the threshold. A pair is not reported if the pair of its ancestors was, like
+// FindSimilarities does not descend into duplicates. The tolerated files are skipped, see LoadOpts.TolerateSize.
+func FindNearDuplicates(root *Node, opts NearDuplicateOpts, onPair func(NearDuplicate)) {
+	weight := func(n *Node) float64 {
+		if opts.ByFileCount {
+			return 1
+		}
+		return float64(n.SizeOf(opts.SizeMode))
+	}
+
+	// order and end are the interval of each directory in the pre-order walk, to tell ancestors.
+	order := make(map[*Node]int)
+	end := make(map[*Node]int)
+	weights := make(map[*Node]float64)
+	filesByHash := make(map[hash][]*Node)
+	var indexRec func(n *Node) float64
+	indexRec = func(n *Node) float64 {
+		if n.IsFile() {
+			if n.Tolerated || weight(n) == 0 {
+				return 0
+			}
+			filesByHash[n.Hash] = append(filesByHash[n.Hash], n)
+			return weight(n)
+		}
+		order[n] = len(order)
+		w := 0.0
+		for _, ch := range n.Children {
+			w += indexRec(ch)
+		}
+		end[n] = len(order)
+		weights[n] = w
+		return w
+	}
+	indexRec(root)
+	// commonWeights are the weights of the files with too many copies under each directory, which can be shared by
+	// any pair.
+	commonWeights := make(map[*Node]float64)
+	var commonRec func(n *Node) float64
+	commonRec = func(n *Node) float64 {
+		if n.IsFile() {
+			if n.Tolerated || len(filesByHash[n.Hash]) <= nearCandidateCopies {
+				return 0
+			}
+			return weight(n)
+		}
+		w := 0.0
+		for _, ch := range n.Children {
+			w += commonRec(ch)
+		}
+		commonWeights[n] = w
+		return w
+	}
+	commonRec(root)
+	related := func(a, b *Node) bool {
+		return (order[a] <= order[b] && order[b] < end[a]) || (order[b] <= order[a] && order[a] < end[b])
+	}
+
+	// bounds sums up the weights of the copies of files in the pairs of directories. With the smaller weight of the
+	// files with too many copies of the pair, it is at least the weight of the shared files.
+	type pair struct{ a, b *Node }
+	newPair := func(a, b *Node) pair {
+		if order[a] > order[b] {
+			return pair{b, a}
+		}
+		return pair{a, b}
+	}
+	bounds := make(map[pair]float64)
+	for _, files := range filesByHash {
+		if len(files) < 2 || len(files) > nearCandidateCopies {
+			continue
+		}
+		for i, f1 := range files {
+			for _, f2 := range files[i+1:] {
+				for a := f1.Parent; a != nil && a != root; a = a.Parent {
+					for b := f2.Parent; b != nil && b != root; b = b.Parent {
+						if related(a, b) || !canReach(weights[a], weights[b], opts.Threshold) {
+							continue
+						}
+						bounds[newPair(a, b)] += weight(f1)
+					}
+				}
+			}
+		}
+	}
+
+	candidates := []pair{}
+	for p, bound := range bounds {
+		bound += math.Min(commonWeights[p.a], commonWeights[p.b])
+		// the Jaccard similarity is at least the threshold only if the shared weight is at least this much.
+		if bound >= opts.Threshold*(weights[p.a]+weights[p.b])/(1+opts.Threshold) && p.a.Hash != p.b.Hash {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if order[candidates[i].a] != order[candidates[j].a] {
+			return order[candidates[i].a] < order[candidates[j].a]
+		}
+		return order[candidates[i].b] < order[candidates[j].b]
+	})
+
+	reported := make(map[pair]bool)
+	for _, p := range candidates {
+		// the pairs under exact duplicates are like the pairs of their copies.
+		isReported := func(a, b *Node) bool {
+			return reported[newPair(a, b)] || (a != b && (a != p.a || b != p.b) && a.Hash == b.Hash)
+		}
+		if reportedAncestors(p.a, p.b, isReported) {
+			continue
+		}
+		nd := compareFiles(p.a, p.b, weight)
+		if nd.Score < opts.Threshold {
+			continue
+		}
+		reported[p] = true
+		onPair(nd)
+	}
+}
+
+// canReach returns false if directories of such weights cannot have the threshold score, which is at most the ratio
+// of the smaller weight to the larger one.
+func canReach(a, b, threshold float64) bool {
+	if a > b {
+		a, b = b, a
+	}
+	return b > 0 && a >= threshold*b
+}
+
+// reportedAncestors returns true if a pair of the ancestors or the nodes themselves is reported.
+func reportedAncestors(a, b *Node, isReported func(a, b *Node) bool) bool {
+	for pa := a; pa != nil; pa = pa.Parent {
+		for pb := b; pb != nil; pb = pb.Parent {
+			if isReported(pa, pb) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compareFiles calculates the score of the pair of directories, and finds the files that differ.
+func compareFiles(a, b *Node, weight func(*Node) float64) NearDuplicate {
+	files := func(root *Node) []*Node {
+		found := []*Node{}
+		WalkAll(root, func(n *Node) {
+			if n.IsFile() && !n.Tolerated && weight(n) > 0 {
+				found = append(found, n)
+			}
+		})
+		return found
+	}
+	nodes := [2]*Node{a, b}
+	all := [2][]*Node{files(a), files(b)}
+	counts := [2]map[hash]int{{}, {}}
+	for i := range all {
+		for _, f := range all[i] {
+			counts[i][f.Hash]++
+		}
+	}
+
+	nd := NearDuplicate{Nodes: nodes}
+	shared, total := 0.0, 0.0
+	for i := range all {
+		other := counts[1-i]
+		// used counts the copies of each hash matched with the other directory so far.
+		used := make(map[hash]int)
+		for _, f := range all[i] {
+			total += weight(f)
+			if used[f.Hash] < other[f.Hash] {
+				used[f.Hash]++
+				shared += weight(f)
+			} else {
+				nd.Differences[i] = append(nd.Differences[i], f)
+			}
+		}
+	}
+	// the shared files are counted in both directories, the union has them once.
+	shared /= 2
+	if union := total - shared; union > 0 {
+		nd.Score = shared / union
+	}
+	return nd
+}
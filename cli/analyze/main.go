@@ -4,8 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"greasytoad/analyze"
+	"greasytoad/listing"
 	"greasytoad/log"
 	libstrings "greasytoad/strings"
+	"io"
+	"math"
 	"os"
 	"runtime/pprof"
 	"sort"
@@ -16,6 +19,15 @@ const (
 	KB = 1 << 10
 )
 
+// toleratedMark marks the tolerated files in the output, see -tolerate.
+const toleratedMark = "~"
+
+// wrapperMark marks the wrapper directories in the output, see -wrappers.
+const wrapperMark = "w"
+
+// nearDuplicateMark marks the pairs of near duplicates in the output, see -near.
+const nearDuplicateMark = "n"
+
 func main() {
 	opts := getOptions()
 	if opts.debug {
@@ -34,21 +46,51 @@ func main() {
 
 	}
 
+	if opts.rejectsPath != "" {
+		f, err := os.Create(opts.rejectsPath)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		defer f.Close()
+		opts.rejects = f
+	}
+
+	if opts.external {
+		if err := printSimilarityExternal(opts); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
 	inputNodes := []*analyze.Node{}
 	for _, path := range opts.paths {
 		log.Printf("loading: %s", path)
-		node, err := loadNode(path, opts.ignoreFilesOrDirs)
+		node, err := loadNode(path, opts)
 		if err != nil {
 			log.Fatalf("cannot load file %s: %v", path, err)
 		}
-		log.Printf("size: %s", libstrings.FormatBytes(node.Size))
+		if node.Header != nil {
+			log.Printf("listing: %s", node.Header)
+		}
+		log.Printf("size: %s, allocated: %s", libstrings.FormatBytes(node.Size), libstrings.FormatBytes(node.Allocated))
 		inputNodes = append(inputNodes, node)
 	}
 
+	if err := checkCompatible(opts.paths, inputNodes); err != nil {
+		if !opts.allowIncompatible {
+			log.Fatalf("%v (use -mix to analyze anyway)", err)
+		}
+		log.Printf("WARNING: %v", err)
+	}
+
 	nameRoots(inputNodes...)
 	tree := mergeNodesIntoSingleTree(inputNodes...)
 
-	if opts.tree {
+	if opts.nearPercent > 0 {
+		printNearDuplicates(tree, opts)
+	} else if opts.subsets {
+		printContained(tree, opts)
+	} else if opts.tree {
 		printSimilarityTree(tree, opts)
 	} else {
 		printSimilarityFlat(tree, opts)
@@ -70,14 +112,156 @@ func printSimilarityFlat(root *analyze.Node, opts options) {
 		}
 	}
 
-	analyze.FindSimilarities(root, func(similarity analyze.SimilarityType, nodes []*analyze.Node) {
+	savings := newSavingsCounter(opts.sizeMode)
+	analyze.FindSimilaritiesOpts(root, similarityOpts(opts), func(similarity analyze.SimilarityType, nodes []*analyze.Node) {
+		savings.add(similarity, nodes)
 		if opts.sort {
 			sort.Slice(nodes, func(i, j int) bool {
 				return nodes[i].FullPath() < nodes[j].FullPath()
 			})
 		}
-		nodePrinter(similarity, nodes)
+		if opts.roots != analyze.AllRoots {
+			fmt.Printf("%s\t%s\t%s\n", similarity, formatRootCounts(analyze.CountByRoot(nodes)), formatNodesPaths(nodes))
+		} else {
+			nodePrinter(similarity, nodes)
+		}
+		if opts.tolerant() && similarity == analyze.FullDuplicate {
+			// the tolerated files that differ between the duplicates.
+			if differences := analyze.ToleratedDifferences(nodes, loadOpts(opts)); len(differences) > 0 {
+				fmt.Printf("%s\t%s\n", toleratedMark, formatNodesPaths(differences))
+			}
+		}
+		if opts.distinctWrappers {
+			// the files held by the wrapper directories.
+			if wrapped := wrappedFiles(nodes); len(wrapped) > 0 {
+				fmt.Printf("%s\t%s\n", wrapperMark, formatNodesPaths(wrapped))
+			}
+		}
 	})
+	log.Printf("removing duplicates would free: %s", libstrings.FormatBytes(savings.total))
+}
+
+// printNearDuplicates prints the pairs of directories that share most of their files, each followed by the files only
+// in the first and only in the second directory.
+func printNearDuplicates(root *analyze.Node, opts options) {
+	nearOpts := analyze.NearDuplicateOpts{
+		Threshold:   float64(opts.nearPercent) / 100,
+		ByFileCount: opts.nearByFiles,
+		SizeMode:    opts.sizeMode,
+	}
+	measure := "bytes"
+	if opts.nearByFiles {
+		measure = "files"
+	}
+	count := 0
+	analyze.FindNearDuplicates(root, nearOpts, func(nd analyze.NearDuplicate) {
+		count++
+		fmt.Printf("%s\t%d%% of %s shared\t%s\n", nearDuplicateMark, int(math.Round(nd.Score*100)), measure, formatNodesPaths(nd.Nodes[:]))
+		for i, mark := range []string{"<", ">"} {
+			if len(nd.Differences[i]) > 0 {
+				fmt.Printf("%s\t%s\n", mark, formatNodesPaths(nd.Differences[i]))
+			}
+		}
+	})
+	log.Printf("near duplicates: %d", count)
+}
+
+// printContained prints the directories whose files are all in another directory with more files, which can be
+// removed. With -v, the extra files of the container follow on a separate line.
+func printContained(root *analyze.Node, opts options) {
+	var total int64
+	analyze.FindContained(root, func(c analyze.Containment) {
+		total += c.Node.SizeOf(opts.sizeMode)
+		fmt.Printf("%s\t%d extra files\t%s\n", analyze.Contained, c.ExtraCount, formatNodesPaths([]*analyze.Node{c.Node, c.Container}))
+		if opts.verbose {
+			fmt.Printf(">\t%s\n", formatNodesPaths(c.Extra()))
+		}
+	})
+	log.Printf("removing contained directories would free: %s", libstrings.FormatBytes(total))
+}
+
+// printSimilarityExternal prints the same lines as printSimilarityFlat, but does not load the listings into memory.
+func printSimilarityExternal(opts options) error {
+	inputs := []io.Reader{}
+	for _, path := range opts.paths {
+		log.Printf("loading: %s", path)
+		f, err := listing.Open(path)
+		if err != nil {
+			return fmt.Errorf("cannot load file %s: %v", path, err)
+		}
+		defer f.Close()
+		inputs = append(inputs, f)
+	}
+	extOpts := analyze.ExternalOpts{
+		LoadOpts:       loadOpts(opts),
+		SimilarityOpts: similarityOpts(opts),
+		TempDir:        opts.tempDir,
+	}
+	return analyze.FindSimilaritiesExternal(inputs, extOpts, func(st analyze.SimilarityType, paths []string) {
+		if opts.sort {
+			sort.Strings(paths)
+		}
+		if opts.roots != analyze.AllRoots {
+			counts := analyze.CountPathsByRoot(paths, len(opts.paths) > 1)
+			fmt.Printf("%s\t%s\t%s\n", st, formatRootCounts(counts), strings.Join(paths, "\t"))
+		} else if opts.verbose {
+			fmt.Printf("%s\t%d\t%s\n", st, len(paths), strings.Join(paths, "\t"))
+		} else {
+			fmt.Printf("%s\t%s\n", st, strings.Join(paths, "\t"))
+		}
+	})
+}
+
+// wrappedFiles returns the files held by the wrapper directories of the nodes.
+func wrappedFiles(nodes []*analyze.Node) []*analyze.Node {
+	wrapped := []*analyze.Node{}
+	for _, n := range nodes {
+		if f := n.Wrapped(); f != nil {
+			wrapped = append(wrapped, f)
+		}
+	}
+	return wrapped
+}
+
+// formatRootCounts formats the number of nodes under each root, e.g. "a:1 b:2".
+func formatRootCounts(counts []analyze.RootCount) string {
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		parts[i] = fmt.Sprintf("%s:%d", c.Root, c.Count)
+	}
+	return strings.Join(parts, " ")
+}
+
+// savingsCounter sums up the bytes that would be freed by keeping only one node of each group of full duplicates.
+type savingsCounter struct {
+	mode    analyze.SizeMode
+	total   int64
+	counted map[*analyze.Node]bool
+}
+
+func newSavingsCounter(mode analyze.SizeMode) *savingsCounter {
+	return &savingsCounter{
+		mode:    mode,
+		counted: make(map[*analyze.Node]bool),
+	}
+}
+
+func (c *savingsCounter) add(st analyze.SimilarityType, nodes []*analyze.Node) {
+	if st != analyze.FullDuplicate || len(nodes) < 2 {
+		return
+	}
+	for _, n := range nodes {
+		// nested groups are already counted with the parent.
+		for p := n; p != nil; p = p.Parent {
+			if c.counted[p] {
+				return
+			}
+		}
+	}
+	for _, n := range nodes {
+		c.counted[n] = true
+	}
+	c.total += int64(len(nodes)-1) * nodes[0].SizeOf(c.mode)
 }
 
 type nodeMeta struct {
@@ -87,7 +271,9 @@ type nodeMeta struct {
 
 func printSimilarityTree(root *analyze.Node, opts options) {
 	meta := make(map[*analyze.Node]nodeMeta)
-	analyze.FindSimilarities(root, func(st analyze.SimilarityType, nodes []*analyze.Node) {
+	savings := newSavingsCounter(opts.sizeMode)
+	analyze.FindSimilaritiesOpts(root, similarityOpts(opts), func(st analyze.SimilarityType, nodes []*analyze.Node) {
+		savings.add(st, nodes)
 		for _, n := range nodes {
 			meta[n] = nodeMeta{st, nodes}
 		}
@@ -100,8 +286,11 @@ func printSimilarityTree(root *analyze.Node, opts options) {
 					fmt.Sprintf("%s %dx%s %s",
 						m.similarityType,
 						len(m.similar),
-						libstrings.FormatBytes(n.Size),
-						m.similar[0].Hash),
+						libstrings.FormatBytes(n.SizeOf(opts.sizeMode)),
+						m.similar[0].HashOf(opts.hashKind)),
+				}
+				if opts.distinctWrappers && n.Wrapped() != nil {
+					decorations = append(decorations, wrapperMark)
 				}
 				if isFirst {
 					decorations = append(decorations, n.FullPath())
@@ -110,6 +299,8 @@ func printSimilarityTree(root *analyze.Node, opts options) {
 			} else {
 				return fmt.Sprintf("\t[%s]", m.similarityType)
 			}
+		} else if opts.tolerant() && n.Tolerated {
+			return fmt.Sprintf("\t[%s]", toleratedMark)
 		} else {
 			return ""
 		}
@@ -127,6 +318,7 @@ func printSimilarityTree(root *analyze.Node, opts options) {
 	}
 
 	printTree(getFirstNamedNode(root), decorator, nodeFilter)
+	log.Printf("removing duplicates would free: %s", libstrings.FormatBytes(savings.total))
 }
 
 func nodeSelectorAll(nodes []*analyze.Node) []*analyze.Node {
@@ -221,28 +413,69 @@ func getNodeSetForPrintTreeDuplicateDirs(root *analyze.Node, meta map[*analyze.N
 	return set
 }
 
-func loadNode(path string, filesOrPathsToIgnore []string) (*analyze.Node, error) {
-	f, err := os.Open(path)
+func loadNode(path string, opts options) (*analyze.Node, error) {
+	f, err := listing.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	opts := analyze.LoadOpts{
-		FilesOrDirsToIgnore: filesOrPathsToIgnore,
+	return analyze.LoadNodesFromFileListOpts(f, loadOpts(opts))
+}
+
+func loadOpts(opts options) analyze.LoadOpts {
+	return analyze.LoadOpts{
+		FilesOrDirsToIgnore: opts.ignoreFilesOrDirs,
+		AllowIncompatible:   opts.allowIncompatible,
+		Format:              opts.format,
+		StatRoot:            opts.statRoot,
+		S3Schema:            opts.s3Schema,
+		NormalizeUnicode:    opts.normalizeUnicode,
+		FoldCase:            opts.foldCase,
+		HashMode:            opts.hashMode,
+		Lenient:             opts.lenient,
+		Rejects:             opts.rejects,
+		Workers:             opts.workers,
+		DistinctWrappers:    opts.distinctWrappers,
+		TolerateSize:        opts.tolerateSize,
+		TolerateNames:       opts.tolerateNames,
 	}
-	return analyze.LoadNodesFromFileListOpts(f, opts)
+}
+
+func similarityOpts(opts options) analyze.SimilarityOpts {
+	return analyze.SimilarityOpts{Hash: opts.hashKind, Roots: opts.roots}
+}
+
+// checkCompatible returns an error if the hashes of the input listings cannot be compared with each other.
+func checkCompatible(paths []string, nodes []*analyze.Node) error {
+	first := -1
+	for i, node := range nodes {
+		if node.Header == nil {
+			continue
+		}
+		if node.Header.Refined != "" && len(nodes) > 1 {
+			log.Printf("WARNING: %s is refined, its files with a unique (%s) hash are not matched with other listings", paths[i], node.Header.Refined)
+		}
+		if first == -1 {
+			first = i
+			continue
+		}
+		if err := listing.CheckCompatible(*nodes[first].Header, *node.Header); err != nil {
+			return fmt.Errorf("incompatible listings %s and %s: %v", paths[first], paths[i], err)
+		}
+	}
+	return nil
 }
 
 func nameRoots(nodes ...*analyze.Node) error {
+	names, err := analyze.RootNames(len(nodes))
+	if err != nil {
+		return err
+	}
 	if len(nodes) == 1 {
 		return nil
 	}
-	letters := "abcdefghijklmnopqrstuvxyz"
-	if len(nodes) > len(letters) {
-		return fmt.Errorf("input too large, max %d entries", len(letters))
-	}
 	for i, node := range nodes {
-		node.Name = fmt.Sprintf("%c", letters[i])
+		node.Name = names[i]
 	}
 	return nil
 }
@@ -250,7 +483,10 @@ func nameRoots(nodes ...*analyze.Node) error {
 func mergeNodesIntoSingleTree(nodes ...*analyze.Node) *analyze.Node {
 	root := analyze.NewNode("")
 	for _, node := range nodes {
-		root.Children[node.Name] = node
+		root.Children = append(root.Children, node)
+		root.Size += node.Size
+		root.Allocated += node.Allocated
+		root.FileCount += node.FileCount
 	}
 	return root
 }
@@ -279,6 +515,33 @@ type options struct {
 	tree                 bool
 	selectDirs           bool
 	selectDuplicatedDirs bool
+	allowIncompatible    bool
+	sizeMode             analyze.SizeMode
+	format               listing.Format
+	statRoot             string
+	s3Schema             []string
+	normalizeUnicode     bool
+	foldCase             bool
+	hashMode             string
+	lenient              bool
+	rejectsPath          string
+	rejects              io.Writer
+	external             bool
+	tempDir              string
+	workers              int
+	hashKind             analyze.HashKind
+	roots                analyze.RootFilter
+	distinctWrappers     bool
+	tolerateSize         int64
+	tolerateNames        []string
+	nearPercent          int
+	nearByFiles          bool
+	subsets              bool
+}
+
+// tolerant returns true if some files are skipped by the hashes of the directories.
+func (o options) tolerant() bool {
+	return o.tolerateSize > 0 || len(o.tolerateNames) > 0
 }
 
 func getOptions() options {
@@ -291,13 +554,77 @@ func getOptions() options {
 	flag.BoolVar(&opts.tree, "t", false, "Print as tree")
 	flag.BoolVar(&opts.selectDirs, "dirs", false, "Select only directories")
 	flag.BoolVar(&opts.selectDuplicatedDirs, "dupdirs", false, "Select only duplicated directories")
+	flag.BoolVar(&opts.allowIncompatible, "mix", false, "Only warn when mixing listings with incompatible hashes")
+	strict := flag.Bool("strict", false, "Compare directories by names and structure as well, so duplicates are literal copies")
+	cross := flag.Bool("cross", false, "Print only the duplicates found in at least two of the listings, with the number of copies in each")
+	intra := flag.Bool("intra", false, "Print only the duplicates with all the copies within one listing, with the number of copies")
+	flag.BoolVar(&opts.distinctWrappers, "wrappers", false, "Do not give a directory with a single file or directory the hash of its child, and report such directories")
+	flag.Var(commaSplitter{&opts.tolerateNames}, "tolerate", "Comma separated patterns of names of files that directories may differ by and still be duplicates, e.g. desktop.ini,.picasa.ini,*.lock")
+	flag.Int64Var(&opts.tolerateSize, "tolsize", 0, "Directories may differ by files smaller than this many bytes and still be duplicates, e.g. 1 for empty files")
+	flag.IntVar(&opts.nearPercent, "near", 0, "Print the pairs of directories that share at least this percentage of bytes instead, with the files that differ")
+	flag.BoolVar(&opts.nearByFiles, "nearfiles", false, "Measure the shared part of -near by the number of files instead of bytes")
+	flag.BoolVar(&opts.subsets, "subsets", false, "Print the directories whose files are all in another directory with more files instead")
+	allocated := flag.Bool("alloc", false, "Account allocated on-disk size instead of apparent size")
+	format := flag.String("f", "", fmt.Sprintf("Listing format, (%s), (%s), (%s) for md5sum, sha256sum etc. manifests, (%s) for fdupes or jdupes output, "+
+		"(%s) for rmlint JSON output, (%s) for S3 Inventory CSV or (%s) for rclone lsjson output. Detected from the first line by default, except for (%s)",
+		listing.TSV, listing.JSON, listing.Checksum, listing.Fdupes, listing.Rmlint, listing.S3Inventory, listing.Rclone, listing.Fdupes))
+	s3Schema := flag.String("s3schema", "", "Columns of S3 Inventory CSV, the fileSchema from its manifest.json (default \""+
+		strings.Join(listing.DefaultS3Schema, ", ")+"\")")
+	flag.BoolVar(&opts.normalizeUnicode, "norm", false, "Match names in different Unicode normalisation forms, e.g. NFD from macOS and NFC from Linux")
+	flag.BoolVar(&opts.foldCase, "icase", false, "Match names that differ only in case, implies -norm")
+	flag.StringVar(&opts.hashMode, "hash", "", "Hash to classify by in listings with several hashes per file, e.g. (h), (s) or (n). The first hash by default")
+	flag.BoolVar(&opts.lenient, "lenient", false, "Skip malformed lines of listings instead of failing")
+	flag.StringVar(&opts.rejectsPath, "rejects", "", "Write the malformed lines skipped with -lenient to this file")
+	flag.BoolVar(&opts.external, "ext", false, "Sort on disk instead of loading the listings into memory, for listings larger than RAM. Flat output only")
+	flag.StringVar(&opts.tempDir, "tmp", "", "Directory for the temporary files of -ext (default the system temporary directory)")
+	flag.StringVar(&opts.statRoot, "stat", "", "Directory to stat files without size against, e.g. for checksum manifests")
 	flag.Var(commaSplitter{&opts.ignoreFilesOrDirs}, "i", fmt.Sprintf("Comma separated of files or directores to ignore (default %+v)", opts.ignoreFilesOrDirs))
+	flag.IntVar(&opts.workers, "j", 0, "Number of goroutines to load the listings with (default the number of CPUs)")
 	flag.StringVar(&opts.profile, "pprof", "", "run profiling")
 	flag.Parse()
 	if len(flag.Args()) == 0 {
-		log.Fatalf("expecting at least one argument with path with the list")
+		log.Fatalf("expecting at least one argument with path with the list, or - for stdin")
 	}
 	opts.paths = flag.Args()
+	var err error
+	if opts.format, err = listing.ParseFormat(*format); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *s3Schema != "" {
+		opts.s3Schema = listing.ParseS3Schema(*s3Schema)
+	}
+	if *allocated {
+		opts.sizeMode = analyze.AllocatedSize
+	}
+	if *strict {
+		if opts.tolerant() {
+			log.Fatalf("-strict compares all the files, it cannot be used with -tolerate or -tolsize")
+		}
+		opts.hashKind = analyze.ByStructure
+	}
+	switch {
+	case *cross && *intra:
+		log.Fatalf("-cross and -intra cannot be used together")
+	case *cross:
+		opts.roots = analyze.CrossRoots
+	case *intra:
+		opts.roots = analyze.IntraRoot
+	}
+	if opts.roots == analyze.CrossRoots && len(opts.paths) < 2 {
+		log.Fatalf("-cross needs at least two listings")
+	}
+	if opts.roots != analyze.AllRoots && (opts.tree || opts.nearPercent > 0 || opts.subsets) {
+		log.Fatalf("-cross and -intra print flat output only")
+	}
+	if opts.rejectsPath != "" {
+		opts.lenient = true
+	}
+	if opts.external && (opts.tree || opts.selectDirs || opts.selectDuplicatedDirs || opts.nearPercent > 0 || opts.subsets) {
+		log.Fatalf("-ext prints flat output only")
+	}
+	if opts.nearPercent < 0 || opts.nearPercent > 100 {
+		log.Fatalf("-near must be a percentage from 1 to 100")
+	}
 	return opts
 }
 
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"greasytoad/listing"
+	"greasytoad/log"
+	"io"
+	"os"
+	"strings"
+)
+
+// fullContentHashMode is the hash mode of listings made with "listfiles -x h".
+const fullContentHashMode = "h"
+
+func main() {
+	opts := getOptions()
+	if opts.debug {
+		log.DebugEnabled = true
+	}
+
+	in, err := listing.Open(opts.path)
+	if err != nil {
+		log.Fatalf("cannot open %s: %v", opts.path, err)
+	}
+	defer in.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	count, algorithm, err := exportChecksums(in, out, opts)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	log.Printf("exported %d files", count)
+	if algorithm != "" {
+		log.Printf("verify with: %ssum -c", algorithm)
+	}
+}
+
+// exportChecksums writes the files of the listing as a checksum manifest, with paths relative to the root of the
+// listing. It returns the number of files and the hash algorithm.
+func exportChecksums(in io.Reader, out io.Writer, opts options) (int, string, error) {
+	// the full content hash is selected from the listings with several hashes per file.
+	reader, err := listing.NewReaderOpts(in, listing.ReaderOpts{Format: opts.format, HashMode: fullContentHashMode})
+	if err != nil {
+		return 0, "", err
+	}
+	defer reader.Close()
+	writer := listing.NewWriter(out, listing.Checksum)
+
+	root := opts.root
+	count := 0
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, "", err
+		}
+		if root == "" {
+			root = guessRoot(reader, entry)
+			log.Printf("root: %s", root)
+		}
+		if entry.Dir {
+			continue
+		}
+		header := reader.Headers()[len(reader.Headers())-1]
+		if header.HashMode != fullContentHashMode {
+			return count, "", fmt.Errorf("only full content hashes can be exported, the listing has hash mode (%s)", header.HashMode)
+		}
+		rel, ok := relativePath(root, entry.Path)
+		if !ok {
+			return count, "", fmt.Errorf("%s is not under the root %s, set the root with -root", entry.Path, root)
+		}
+		entry.Path = rel
+		if err := writer.WriteEntry(entry); err != nil {
+			return count, "", err
+		}
+		count++
+	}
+
+	algorithm := ""
+	if headers := reader.Headers(); len(headers) > 0 {
+		algorithm = headers[0].Algorithm
+		for _, h := range headers {
+			if err := listing.CheckCompatible(*headers[0], *h); err != nil {
+				return count, "", fmt.Errorf("incompatible listings in input: %v", err)
+			}
+		}
+	}
+	return count, algorithm, nil
+}
+
+// guessRoot returns the directory that the paths are relative to. The first directory entry of a listing is the
+// directory the scan started at, and the paths of the entries start with it. Listings without directory entries fall
+// back to the root from the header.
+func guessRoot(reader listing.Reader, first listing.Entry) string {
+	if first.Dir {
+		return first.Path
+	}
+	if headers := reader.Headers(); len(headers) > 0 && headers[0].Root != "" {
+		return headers[0].Root
+	}
+	return "."
+}
+
+func relativePath(root, path string) (string, bool) {
+	if root == "." || root == "" {
+		return strings.TrimPrefix(path, "./"), true
+	}
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
+}
+
+type options struct {
+	debug  bool
+	path   string
+	root   string
+	format listing.Format
+}
+
+func getOptions() options {
+	opts := options{}
+	flag.BoolVar(&opts.debug, "d", false, "Debug logging")
+	flag.StringVar(&opts.root, "root", "", "Write paths relative to this directory (default the directory the listing was made at)")
+	format := flag.String("f", "", fmt.Sprintf("Listing format, (%s) or (%s), detected from the first line by default", listing.TSV, listing.JSON))
+	flag.Parse()
+	var err error
+	if opts.format, err = listing.ParseFormat(*format); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(flag.Args()) != 1 {
+		log.Fatalf("expected path of a listing made with full content hashes as the argument, or - for stdin")
+	}
+	opts.path = flag.Arg(0)
+	return opts
+}
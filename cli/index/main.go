@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"greasytoad/listing"
+	"greasytoad/log"
+	"os"
+)
+
+func main() {
+	opts := getOptions()
+	if opts.debug {
+		log.DebugEnabled = true
+	}
+
+	in, err := listing.Open(opts.path)
+	if err != nil {
+		log.Fatalf("cannot open %s: %v", opts.path, err)
+	}
+	defer in.Close()
+
+	reader, err := listing.NewReaderOpts(in, listing.ReaderOpts{Format: opts.format, HashMode: opts.hashMode, AllHashes: opts.hashMode == ""})
+	if err != nil {
+		log.Fatalf("cannot read %s: %v", opts.path, err)
+	}
+	defer reader.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	if opts.dump {
+		err = listing.WriteListing(listing.NewWriter(out, opts.dumpFormat), reader)
+	} else {
+		err = listing.WriteIndex(out, reader)
+	}
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+}
+
+type options struct {
+	debug      bool
+	dump       bool
+	path       string
+	hashMode   string
+	format     listing.Format
+	dumpFormat listing.Format
+}
+
+func getOptions() options {
+	opts := options{}
+	flag.BoolVar(&opts.debug, "d", false, "Debug logging")
+	flag.BoolVar(&opts.dump, "dump", false, "Write the listing back as text instead of building the index")
+	format := flag.String("f", "", "Format of the input listing, detected by default")
+	flag.StringVar(&opts.hashMode, "hash", "", "Hash kept from listings with several hashes per file, all the hashes by default")
+	dumpFormat := flag.String("to", string(listing.TSV), fmt.Sprintf("Format of the text listing with -dump, (%s) or (%s)", listing.TSV, listing.JSON))
+	flag.Parse()
+	var err error
+	if opts.format, err = listing.ParseFormat(*format); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if opts.dumpFormat, err = listing.ParseFormat(*dumpFormat); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if opts.dumpFormat != listing.TSV && opts.dumpFormat != listing.JSON {
+		log.Fatalf("bad text format: %s", *dumpFormat)
+	}
+	if len(flag.Args()) != 1 {
+		log.Fatalf("expected path of a listing or an index as the argument, or - for stdin")
+	}
+	opts.path = flag.Arg(0)
+	return opts
+}
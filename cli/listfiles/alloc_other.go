@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "io/fs"
+
+// allocatedSize falls back to the apparent size where the block count is not available.
+func allocatedSize(info fs.FileInfo) int64 {
+	return info.Size()
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	libhash "greasytoad/hash"
+	"greasytoad/listing"
 	strings "greasytoad/strings"
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"os"
 	gopath "path"
+	"path/filepath"
 	"sort"
+	gostrings "strings"
+	"time"
 )
 
 var debugEnabled = false
@@ -18,9 +24,17 @@ func main() {
 	opts := getOptions()
 	debugEnabled = opts.debug
 
+	stdout := bufio.NewWriter(os.Stdout)
+	compressed, err := listing.NewCompressWriter(stdout, opts.compression)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	out := listing.NewWriter(compressed, opts.format)
 	ignoredCount := 0
 	fileCount := 0
+	dirCount := 0
 	var totalSize int64 = 0
+	var totalAllocated int64 = 0
 	printFileInfo := func(path string, info fs.FileInfo) error {
 		switch {
 		case info.Mode().IsRegular():
@@ -29,8 +43,13 @@ func main() {
 			if err != nil {
 				return err
 			}
-			fmt.Printf("%s\t%d\t%s\n", path, size, h)
+			allocated := allocatedSize(info)
+			entry := listing.Entry{Path: path, Size: size, Hash: string(h), Allocated: allocated}
+			if err := out.WriteEntry(entry); err != nil {
+				return err
+			}
 			totalSize += size
+			totalAllocated += allocated
 			fileCount++
 		default:
 			logDebug("not a file, ignoring: %s", path)
@@ -38,20 +57,64 @@ func main() {
 		}
 		return nil
 	}
+	printDirInfo := func(path string) error {
+		// the hash of a directory is derived from the content by analyze.
+		dirCount++
+		return out.WriteEntry(listing.Entry{Path: path, Dir: true})
+	}
 
 	logInfo("start at: %s", opts.startPath)
-	if err := listFilesRec(opts.startPath, printFileInfo); err != nil {
+	header := newHeader(opts)
+	if err := out.WriteHeader(header); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := listFilesRec(opts.startPath, printDirInfo, printFileInfo); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	header.End = time.Now().UTC()
+	if err := out.WriteTrailer(header); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := compressed.Close(); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := stdout.Flush(); err != nil {
 		log.Fatalf("ERROR: %v", err)
 	}
 	logInfo("ignored: %d", ignoredCount)
 	logInfo("file count: %d", fileCount)
+	logInfo("dir count: %d", dirCount)
 	logInfo("total file size: %s (%d)", formatSize(totalSize), totalSize)
+	logInfo("total allocated size: %s (%d)", formatSize(totalAllocated), totalAllocated)
+}
+
+func newHeader(opts options) listing.Header {
+	root, err := filepath.Abs(opts.startPath)
+	if err != nil {
+		root = opts.startPath
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		logDebug("cannot get hostname: %v", err)
+	}
+	return listing.Header{
+		Version:   listing.FormatVersion,
+		HashMode:  opts.hashMode,
+		Algorithm: libhash.Algorithm,
+		Root:      root,
+		Host:      host,
+		Start:     time.Now().UTC(),
+		Tool:      listing.ToolVersion,
+	}
 }
 
 type options struct {
 	startPath    string
 	debug        bool
+	hashMode     string
 	hashFunction libhash.FileHashFunc
+	format       listing.Format
+	compression  listing.Compression
 }
 
 const (
@@ -65,16 +128,42 @@ func getOptions() options {
 	flag.BoolVar(&opts.debug, "v", false, "verbose logging")
 	var hashFuncSelect string
 	flag.StringVar(&hashFuncSelect, "x", hashFuncOptionFull,
-		fmt.Sprintf("hash options. (%s) full file, (%s) sample from the middle of the file, name and size, and (%s) name and size only",
-			hashFuncOptionFull, hashFuncOptionSample, hashFuncOptionNameSize))
+		fmt.Sprintf("hash options. (%s) full file, (%s) sample from the middle of the file, name and size, and (%s) name and size only. "+
+			"Several comma separated options compute several hashes per file in a single read, e.g. %s,%s,%s",
+			hashFuncOptionFull, hashFuncOptionSample, hashFuncOptionNameSize, hashFuncOptionNameSize, hashFuncOptionSample, hashFuncOptionFull))
+	var format string
+	flag.StringVar(&format, "f", string(listing.TSV), fmt.Sprintf("output format, (%s) tab separated or (%s) JSON object per line", listing.TSV, listing.JSON))
+	var compression string
+	flag.StringVar(&compression, "z", "", fmt.Sprintf("compress output with (%s) or (%s)", listing.Gzip, listing.Zstd))
 	flag.Parse()
 
-	switch hashFuncSelect {
-	case hashFuncOptionFull:
+	var err error
+	if opts.format, err = listing.ParseFormat(format); err != nil {
+		log.Fatal(err)
+	}
+	if opts.format != listing.TSV && opts.format != listing.JSON {
+		log.Fatalf("bad output format: %s", format)
+	}
+	if opts.compression, err = listing.ParseCompression(compression); err != nil {
+		log.Fatal(err)
+	}
+	opts.hashMode = hashFuncSelect
+	hashModes := listing.HashModes(hashFuncSelect)
+	for _, mode := range hashModes {
+		switch mode {
+		case hashFuncOptionFull, hashFuncOptionSample, hashFuncOptionNameSize:
+		default:
+			log.Fatalf("bad hash option: %s", mode)
+		}
+	}
+	switch {
+	case len(hashModes) > 1:
+		opts.hashFunction = multiHashFunction(hashModes)
+	case hashFuncSelect == hashFuncOptionFull:
 		opts.hashFunction = libhash.GetFullContentHash
-	case hashFuncOptionSample:
+	case hashFuncSelect == hashFuncOptionSample:
 		opts.hashFunction = libhash.GetSampleHash
-	case hashFuncOptionNameSize:
+	case hashFuncSelect == hashFuncOptionNameSize:
 		opts.hashFunction = libhash.GetNameSizeHash
 	default:
 		log.Fatalf("bad hash option: %s", hashFuncSelect)
@@ -86,12 +175,30 @@ func getOptions() options {
 	return opts
 }
 
-func listFilesRec(path string, onFile func(string, fs.FileInfo) error) error {
+// multiHashFunction returns a hash function that writes several hashes of a file separated with listing.HashSeparator.
+func multiHashFunction(modes []string) libhash.FileHashFunc {
+	return func(path string, info fs.FileInfo) (libhash.HashString, error) {
+		hashes, err := libhash.GetMultiHash(path, info, modes)
+		if err != nil {
+			return "", err
+		}
+		joined := make([]string, len(hashes))
+		for i, h := range hashes {
+			joined[i] = string(h)
+		}
+		return libhash.HashString(gostrings.Join(joined, listing.HashSeparator)), nil
+	}
+}
+
+func listFilesRec(path string, onDir func(string) error, onFile func(string, fs.FileInfo) error) error {
 	infos, err := ioutil.ReadDir(path)
 	logDebug("got %d items in dir %s", len(infos), path)
 	if err != nil {
 		return fmt.Errorf("listFilesRec: error on %s: %v", path, err)
 	}
+	if err := onDir(path); err != nil {
+		return fmt.Errorf("error on dir: %s: %v", path, err)
+	}
 	sort.Slice(infos, func(i, j int) bool {
 		return infos[i].Name() < infos[j].Name()
 	})
@@ -99,7 +206,7 @@ func listFilesRec(path string, onFile func(string, fs.FileInfo) error) error {
 		switch {
 		case info.IsDir():
 			dirPath := gopath.Join(path, info.Name())
-			if err := listFilesRec(dirPath, onFile); err != nil {
+			if err := listFilesRec(dirPath, onDir, onFile); err != nil {
 				logInfo("error: %v", err) // e.g. permission denied
 				continue
 			}
@@ -124,5 +231,5 @@ func logDebug(format string, args ...interface{}) {
 }
 
 func formatSize(size int64) string {
-	return strings.FormatBytes(int(size))
+	return strings.FormatBytes(size)
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	libhash "greasytoad/hash"
+	"greasytoad/listing"
+	"greasytoad/log"
+	libstrings "greasytoad/strings"
+	"os"
+)
+
+func main() {
+	opts := getOptions()
+	if opts.debug {
+		log.DebugEnabled = true
+	}
+
+	in, err := listing.Open(opts.path)
+	if err != nil {
+		log.Fatalf("cannot open %s: %v", opts.path, err)
+	}
+	defer in.Close()
+
+	// all the hashes are kept, the first hash of the files with several hashes is refined.
+	reader, err := listing.NewReaderOpts(in, listing.ReaderOpts{Format: opts.format, AllHashes: true})
+	if err != nil {
+		log.Fatalf("cannot read %s: %v", opts.path, err)
+	}
+	defer reader.Close()
+	recorded, err := listing.Record(reader)
+	if err != nil {
+		log.Fatalf("cannot read %s: %v", opts.path, err)
+	}
+
+	stats := listing.Refine(recorded, fullContentHash, func(e listing.Entry, err error) {
+		log.Printf("WARNING: not refined, never a duplicate: %v", err)
+	})
+	log.Printf("candidate groups: %d, of them not duplicates: %d", stats.Groups, stats.Split)
+	log.Printf("refined files: %d, failed: %d, read %s of %s", stats.Refined, stats.Failed,
+		libstrings.FormatBytes(stats.ReadSize), libstrings.FormatBytes(stats.TotalSize))
+
+	stdout := bufio.NewWriter(os.Stdout)
+	compressed, err := listing.NewCompressWriter(stdout, opts.compression)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := listing.WriteListing(listing.NewWriter(compressed, opts.outFormat), recorded); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := compressed.Close(); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if err := stdout.Flush(); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+}
+
+// fullContentHash returns the full content hash of the file of the entry. It fails if the file changed its size since
+// the listing was made.
+func fullContentHash(e listing.Entry) (string, error) {
+	info, err := os.Stat(e.Path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("not a file: %s", e.Path)
+	}
+	if e.Size != listing.UnknownSize && info.Size() != e.Size {
+		return "", fmt.Errorf("size of %s changed from %d to %d", e.Path, e.Size, info.Size())
+	}
+	h, err := libhash.GetFullContentHash(e.Path, info)
+	return string(h), err
+}
+
+type options struct {
+	debug       bool
+	path        string
+	format      listing.Format
+	outFormat   listing.Format
+	compression listing.Compression
+}
+
+func getOptions() options {
+	opts := options{}
+	flag.BoolVar(&opts.debug, "d", false, "Debug logging")
+	format := flag.String("f", "", "Format of the input listing, detected by default")
+	outFormat := flag.String("to", string(listing.TSV), fmt.Sprintf("Format of the refined listing, (%s) or (%s)", listing.TSV, listing.JSON))
+	compression := flag.String("z", "", fmt.Sprintf("compress output with (%s) or (%s)", listing.Gzip, listing.Zstd))
+	flag.Parse()
+	var err error
+	if opts.format, err = listing.ParseFormat(*format); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if opts.outFormat, err = listing.ParseFormat(*outFormat); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if opts.outFormat != listing.TSV && opts.outFormat != listing.JSON {
+		log.Fatalf("bad output format: %s", *outFormat)
+	}
+	if opts.compression, err = listing.ParseCompression(*compression); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(flag.Args()) != 1 {
+		log.Fatalf("expected path of a listing made with sample or name and size hashes as the argument, or - for stdin")
+	}
+	opts.path = flag.Arg(0)
+	return opts
+}
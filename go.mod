@@ -1,8 +1,12 @@
 module greasytoad
 
-go 1.17
+go 1.22
 
-require github.com/stretchr/testify v1.7.0
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/text v0.21.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
@@ -8,6 +8,9 @@ import (
 	"os"
 )
 
+// Algorithm is the digest used by all the hash functions.
+const Algorithm = "md5"
+
 const (
 	sampleHashSize = 1024
 	nilHash        = "?"
@@ -64,10 +67,7 @@ func readSample(path string, info fs.FileInfo, sampleSize int64) ([]byte, error)
 		return []byte{}, nil
 	}
 
-	var offset int64 = 0
-	if fileSize > sampleSize {
-		offset = (fileSize - sampleSize) / 2
-	}
+	offset := sampleOffset(fileSize, sampleSize)
 	_, err = f.Seek(offset, 0)
 	if err != nil {
 		return nil, err
@@ -81,6 +81,56 @@ func readSample(path string, info fs.FileInfo, sampleSize int64) ([]byte, error)
 	return buf[:nRead], nil
 }
 
+func sampleOffset(fileSize, sampleSize int64) int64 {
+	if fileSize > sampleSize {
+		return (fileSize - sampleSize) / 2
+	}
+	return 0
+}
+
+// GetMultiHash returns the hashes of the given kinds in the same order. The kinds are the prefixes of the hashes, i.e.
+// "h" for full content, "s" for sample and "n" for name and size. The file is read at most once, the sample is taken
+// from the full content if both are needed.
+func GetMultiHash(path string, info fs.FileInfo, kinds []string) ([]HashString, error) {
+	var content []byte
+	for _, kind := range kinds {
+		if kind == "h" {
+			var err error
+			if content, err = ioutil.ReadFile(path); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	hashes := make([]HashString, 0, len(kinds))
+	for _, kind := range kinds {
+		var h HashString
+		var err error
+		switch kind {
+		case "h":
+			h, err = calculateHash(content)
+		case "s":
+			var sample []byte
+			if content != nil {
+				offset := sampleOffset(int64(len(content)), sampleHashSize)
+				sample = content[offset:min(offset+sampleHashSize, int64(len(content)))]
+			} else if sample, err = readSample(path, info, sampleHashSize); err != nil {
+				return nil, err
+			}
+			h, err = calculateHash([]byte(getNameAndSize(info)), sample)
+		case "n":
+			h, err = calculateHash([]byte(getNameAndSize(info)))
+		default:
+			return nil, fmt.Errorf("unknown hash kind: %s", kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, HashString(kind)+h)
+	}
+	return hashes, nil
+}
+
 func getNameAndSize(info fs.FileInfo) string {
 	return fmt.Sprintf("%s+%d", info.Name(), info.Size())
 }
@@ -0,0 +1,99 @@
+package listing
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// fullHashPrefix is the prefix of full content hashes, see the hash package.
+const fullHashPrefix = "h"
+
+// UnknownSize is the size of entries from listings that do not record sizes, e.g. checksum manifests.
+const UnknownSize = -1
+
+var (
+	// "<hex digest>  <path>" or "<hex digest> *<path>" as written by md5sum, sha256sum, b2sum etc.
+	gnuChecksumLine = regexp.MustCompile(`^\\?([0-9a-fA-F]{32,128}) [ *](.*)$`)
+	// "<ALGORITHM> (<path>) = <hex digest>" as written with --tag or by BSD md5, sha256 etc. b2sum writes "BLAKE2b".
+	bsdChecksumLine = regexp.MustCompile(`^\\?([A-Za-z0-9-]+) ?\((.*)\) ?= ([0-9a-fA-F]{32,128})$`)
+)
+
+// isChecksumLine returns true for lines of a checksum manifest.
+func isChecksumLine(line string) bool {
+	return gnuChecksumLine.MatchString(line) || bsdChecksumLine.MatchString(line)
+}
+
+// parseChecksumEntry parses a line of a checksum manifest. Manifests do not hold sizes, so the size is UnknownSize.
+// The digest is prefixed like a full content hash of listfiles, so MD5 manifests match listings made with "-x h".
+func parseChecksumEntry(line string) (Entry, error) {
+	line = strings.TrimRight(line, "\r\n")
+	escaped := strings.HasPrefix(line, "\\")
+	var digest, path, algorithm string
+	if m := gnuChecksumLine.FindStringSubmatch(line); m != nil {
+		digest, path = m[1], m[2]
+		algorithm = algorithmFromDigestLength(len(digest))
+	} else if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+		algorithm, path, digest = strings.ToLower(m[1]), m[2], m[3]
+	} else {
+		return Entry{}, fmt.Errorf("bad line: not a checksum line, `%v`", line)
+	}
+	if escaped {
+		path = unescapeChecksumPath(path)
+	}
+	return Entry{
+		Path:      strings.TrimSuffix(path, "/"),
+		Size:      UnknownSize,
+		Hash:      fullHashPrefix + strings.ToLower(digest),
+		Allocated: UnknownSize,
+		Algorithm: algorithm,
+	}, nil
+}
+
+// algorithmFromDigestLength guesses the algorithm of untagged manifests. SHA-512 and BLAKE2b have the same length,
+// so the algorithm is left unknown for those.
+func algorithmFromDigestLength(length int) string {
+	switch length {
+	case 32:
+		return "md5"
+	case 40:
+		return "sha1"
+	case 56:
+		return "sha224"
+	case 64:
+		return "sha256"
+	case 96:
+		return "sha384"
+	default:
+		return ""
+	}
+}
+
+// writeChecksumEntry writes the file in the format of md5sum, sha256sum etc. Directories are skipped, and only full
+// content hashes can be written.
+func writeChecksumEntry(w io.Writer, e Entry) error {
+	if e.Dir {
+		return nil
+	}
+	if !strings.HasPrefix(e.Hash, fullHashPrefix) {
+		return fmt.Errorf("not a full content hash: %s %s", e.Hash, e.Path)
+	}
+	digest := strings.TrimPrefix(e.Hash, fullHashPrefix)
+	path, prefix := e.Path, ""
+	if strings.ContainsAny(path, "\\\n\r") {
+		path, prefix = escapeChecksumPath(path), "\\"
+	}
+	_, err := fmt.Fprintf(w, "%s%s  %s\n", prefix, digest, path)
+	return err
+}
+
+// escapeChecksumPath escapes the file name like GNU coreutils. Such lines are prefixed with a backslash.
+func escapeChecksumPath(path string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(path)
+}
+
+// unescapeChecksumPath reverts the escaping of GNU coreutils, used for file names with a backslash or a new line.
+func unescapeChecksumPath(path string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(path)
+}
@@ -0,0 +1,111 @@
+package listing
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultS3Schema is the order of the columns of an S3 Inventory CSV, if not given. The actual order is in the
+// "fileSchema" of the manifest.json of the inventory.
+var DefaultS3Schema = []string{"Bucket", "Key", "Size", "LastModifiedDate", "ETag", "StorageClass"}
+
+// ParseS3Schema parses the "fileSchema" of the manifest.json of an S3 Inventory, e.g. "Bucket, Key, Size, ETag".
+func ParseS3Schema(s string) []string {
+	columns := []string{}
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+func isS3InventoryLine(line string) bool {
+	return strings.HasPrefix(line, `"`)
+}
+
+// parseS3InventoryEntry parses a line of S3 Inventory CSV. The path is the bucket and the key, so the buckets are the
+// top level directories. The ETag is the MD5 of the content for objects not uploaded in parts, so the hash is prefixed
+// like a full content hash of listfiles and such objects match local listings made with "-x h". ok is false for
+// delete markers and non-current versions.
+func parseS3InventoryEntry(schema []string, line string) (Entry, bool, error) {
+	record, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("bad line: %v, `%v`", err, line)
+	}
+	if len(record) < len(schema) {
+		return Entry{}, false, fmt.Errorf("bad line: %d columns, expected %d, `%v`", len(record), len(schema), line)
+	}
+	columns := make(map[string]string)
+	for i, name := range schema {
+		columns[name] = record[i]
+	}
+	if columns["IsDeleteMarker"] == "true" || columns["IsLatest"] == "false" {
+		return Entry{}, false, nil
+	}
+	key, err := url.QueryUnescape(columns["Key"])
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("bad key: %v, `%v`", err, line)
+	}
+	entry := Entry{
+		Path:      strings.TrimSuffix(columns["Bucket"]+"/"+key, "/"),
+		Dir:       strings.HasSuffix(key, "/"),
+		Algorithm: "md5",
+	}
+	if entry.Dir {
+		// "folders" created in the S3 console are empty objects with a trailing slash.
+		return entry, true, nil
+	}
+	if entry.Size, err = strconv.ParseInt(columns["Size"], 10, 64); err != nil {
+		return Entry{}, false, fmt.Errorf("bad size: %v, `%v`", err, line)
+	}
+	entry.Allocated = entry.Size
+	entry.Hash = fullHashPrefix + strings.ToLower(strings.Trim(columns["ETag"], `"`))
+	return entry, true, nil
+}
+
+// rcloneRecord is an element of the JSON array written by "rclone lsjson --hash".
+type rcloneRecord struct {
+	Path   string            `json:"Path"`
+	Size   int64             `json:"Size"`
+	IsDir  bool              `json:"IsDir"`
+	Hashes map[string]string `json:"Hashes"`
+}
+
+// parseRcloneRecord prefers the MD5 hash, so the objects match local listings made with "-x h". Remotes without MD5
+// use the first of the other hashes, the algorithm is recorded so incompatible listings are not mixed.
+func parseRcloneRecord(raw json.RawMessage) (Entry, bool, error) {
+	record := rcloneRecord{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return Entry{}, false, fmt.Errorf("bad rclone output: %v", err)
+	}
+	if record.Path == "" {
+		return Entry{}, false, fmt.Errorf("bad rclone output: no path, `%s`", raw)
+	}
+	entry := Entry{Path: strings.TrimSuffix(record.Path, "/"), Dir: record.IsDir}
+	if entry.Dir {
+		return entry, true, nil
+	}
+	entry.Size = record.Size
+	entry.Allocated = record.Size
+	algorithm, digest := "md5", record.Hashes["md5"]
+	if digest == "" {
+		algorithms := []string{}
+		for a := range record.Hashes {
+			algorithms = append(algorithms, a)
+		}
+		sort.Strings(algorithms)
+		if len(algorithms) == 0 {
+			return Entry{}, false, fmt.Errorf("rclone output without hashes, use lsjson --hash: %s", record.Path)
+		}
+		algorithm, digest = algorithms[0], record.Hashes[algorithms[0]]
+	}
+	entry.Algorithm = algorithm
+	entry.Hash = fullHashPrefix + strings.ToLower(digest)
+	return entry, true, nil
+}
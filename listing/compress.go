@@ -0,0 +1,99 @@
+package listing
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of the listing.
+type Compression string
+
+const (
+	NoCompression Compression = ""
+	Gzip          Compression = "gzip"
+	Zstd          Compression = "zstd"
+)
+
+// StdinPath is the path that stands for standard input.
+const StdinPath = "-"
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ParseCompression parses the compression name, as given on the command line.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case NoCompression, Gzip, Zstd:
+		return c, nil
+	default:
+		return NoCompression, fmt.Errorf("unknown compression: %s", s)
+	}
+}
+
+// NewCompressWriter returns a writer compressing to w. Close must be called to flush the compressed stream, it does
+// not close w.
+func NewCompressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", c)
+	}
+}
+
+// NewDecompressReader detects the compression of the input by its magic bytes and returns a reader with the
+// decompressed content. Uncompressed input is returned as is.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	switch DetectCompression(br) {
+	case Gzip:
+		return gzip.NewReader(br)
+	case Zstd:
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// DetectCompression peeks at the magic bytes, without consuming them.
+func DetectCompression(r *bufio.Reader) Compression {
+	if magic, _ := r.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		return Gzip
+	}
+	if magic, _ := r.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		return Zstd
+	}
+	return NoCompression
+}
+
+// Open opens the listing file, or standard input for "-". The content is not decompressed, the loader does that.
+func Open(path string) (io.ReadCloser, error) {
+	if path == StdinPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package listing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// groupHashPrefix is the prefix of the synthetic hashes of duplicate groups imported from fdupes, jdupes or rmlint.
+// The files of a group share the hash, the files not reported as duplicates are not in the listing at all.
+const groupHashPrefix = "g"
+
+// fdupesSizeLine is printed before a group with "fdupes -S" or "jdupes -S".
+var fdupesSizeLine = regexp.MustCompile(`^(\d+) bytes? each:$`)
+
+// fdupesState tracks the current group while reading fdupes output line by line.
+type fdupesState struct {
+	inGroup   bool
+	groupHash string
+	groupSize int64
+	hasSize   bool
+}
+
+// parseLine returns ok false for lines that are not files, i.e. group separators and sizes.
+func (s *fdupesState) parseLine(line string) (Entry, bool, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		s.inGroup = false
+		s.hasSize = false
+		return Entry{}, false, nil
+	}
+	if m := fdupesSizeLine.FindStringSubmatch(line); m != nil && !s.inGroup {
+		size, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		s.groupSize, s.hasSize = size, true
+		return Entry{}, false, nil
+	}
+	if !s.inGroup {
+		// the group is identified by its first file, so groups from different reports do not match by accident. The
+		// path is digested, so the hash never contains a HashSeparator like in listings with several hashes per file.
+		s.inGroup = true
+		digest := sha256.Sum256([]byte(line))
+		s.groupHash = groupHashPrefix + hex.EncodeToString(digest[:])
+		if !s.hasSize {
+			s.groupSize = UnknownSize
+		}
+	}
+	entry := Entry{
+		Path:      line,
+		Size:      s.groupSize,
+		Hash:      s.groupHash,
+		Allocated: s.groupSize,
+		Algorithm: string(Fdupes),
+	}
+	return entry, true, nil
+}
+
+// rmlintRecord is an element of the JSON array written by rmlint. The first element is the description of the run,
+// the last one holds the totals.
+type rmlintRecord struct {
+	Type         string `json:"type"`
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	Digest       string `json:"digest"`
+	ChecksumType string `json:"checksum_type"`
+	Cwd          string `json:"cwd"`
+	Version      string `json:"version"`
+	Description  string `json:"description"`
+}
+
+func isRmlintRecord(raw json.RawMessage) bool {
+	record := rmlintRecord{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return false
+	}
+	return record.Type != "" || record.Description != "" || record.ChecksumType != ""
+}
+
+func newRmlintHeader() *Header {
+	return &Header{HashMode: groupHashPrefix, Algorithm: string(Rmlint)}
+}
+
+// parseRmlintRecord returns ok false for records other than duplicate files and empty directories. The description
+// of the run updates the header.
+func parseRmlintRecord(h *Header, raw json.RawMessage) (Entry, bool, error) {
+	record := rmlintRecord{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return Entry{}, false, fmt.Errorf("bad rmlint output: %v", err)
+	}
+	switch record.Type {
+	case "duplicate_file":
+		return Entry{
+			Path:      record.Path,
+			Size:      record.Size,
+			Hash:      groupHashPrefix + record.Digest,
+			Allocated: record.Size,
+		}, true, nil
+	case "emptydir":
+		return Entry{Path: strings.TrimSuffix(record.Path, "/"), Dir: true}, true, nil
+	case "":
+		// the description of the run, or the totals at the end.
+		if record.ChecksumType != "" {
+			h.Algorithm = string(Rmlint) + "/" + record.ChecksumType
+		}
+		if record.Cwd != "" {
+			h.Root = record.Cwd
+		}
+		if record.Version != "" {
+			h.Tool = string(Rmlint) + " " + record.Version
+		}
+	}
+	return Entry{}, false, nil
+}
@@ -0,0 +1,159 @@
+package listing
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Format of the listing.
+type Format string
+
+const (
+	// AutoFormat detects the format from the first line of the listing.
+	AutoFormat Format = ""
+	// TSV is a tab separated line per file, with the header in "#key<TAB>value" lines.
+	TSV Format = "tsv"
+	// JSON is a JSON object per line (JSON Lines), with the header and the trailer in separate objects.
+	JSON Format = "json"
+	// Checksum is a manifest written by md5sum, sha256sum, b2sum etc. It has no header and no sizes.
+	Checksum Format = "sum"
+	// Fdupes is the output of fdupes or jdupes, with groups of duplicated files separated by empty lines. Only the
+	// duplicated files are in the listing.
+	Fdupes Format = "fdupes"
+	// Rmlint is the JSON output of rmlint. Only the duplicated files and empty directories are in the listing.
+	Rmlint Format = "rmlint"
+	// S3Inventory is the CSV of an S3 Inventory report, the order of the columns is in its manifest.json.
+	S3Inventory Format = "s3"
+	// Rclone is the output of "rclone lsjson --hash", use with -R for the whole tree.
+	Rclone Format = "rclone"
+	// Index is the binary index, see WriteIndex. It is detected by the magic bytes.
+	Index Format = "index"
+)
+
+// ParseFormat parses the format name, as given on the command line.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case AutoFormat, TSV, JSON, Checksum, Fdupes, Rmlint, S3Inventory, Rclone, Index:
+		return f, nil
+	default:
+		return AutoFormat, fmt.Errorf("unknown listing format: %s", s)
+	}
+}
+
+// DetectFormat guesses the format from the first line of the listing.
+func DetectFormat(line string) Format {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return JSON
+	}
+	if isChecksumLine(line) {
+		return Checksum
+	}
+	if isS3InventoryLine(line) {
+		return S3Inventory
+	}
+	return TSV
+}
+
+// Entry is a single file or directory in the listing.
+type Entry struct {
+	// Path does not have a trailing slash, also for directories.
+	Path      string
+	Dir       bool
+	Size      int64
+	Hash      string
+	Allocated int64
+	// Algorithm of the hash, set only if the format records it per entry.
+	Algorithm string
+}
+
+// IsHeaderLine returns true for lines holding header (or trailer) entries.
+func (f Format) IsHeaderLine(line string) bool {
+	switch f {
+	case JSON:
+		return isJSONHeaderLine(line)
+	case Checksum, Fdupes, S3Inventory:
+		return false
+	}
+	return isTSVHeaderLine(line)
+}
+
+// IsHeaderStart returns true for the first line of a header block. A listing has a single header, more of them mean
+// that several listings were concatenated.
+func (f Format) IsHeaderStart(line string) bool {
+	switch f {
+	case JSON:
+		return isJSONHeaderStart(line)
+	case Checksum, Fdupes, S3Inventory:
+		return false
+	}
+	return isTSVHeaderStart(line)
+}
+
+// ParseHeaderLine updates the header with a single header line.
+func (f Format) ParseHeaderLine(h *Header, line string) error {
+	if f == JSON {
+		return parseJSONHeaderLine(h, line)
+	}
+	return parseTSVHeaderLine(h, line)
+}
+
+// ParseEntry parses a line that is not a header line.
+func (f Format) ParseEntry(line string) (Entry, error) {
+	switch f {
+	case JSON:
+		return parseJSONEntry(line)
+	case Checksum:
+		return parseChecksumEntry(line)
+	case Fdupes, S3Inventory:
+		return Entry{}, fmt.Errorf("%s cannot be parsed line by line", f)
+	case Rmlint, Rclone, Index:
+		return Entry{}, fmt.Errorf("%s is not a line per entry", f)
+	}
+	return parseTSVEntry(line)
+}
+
+// Writer writes a listing in the given format. Checksum manifests hold only files with full content hashes.
+type Writer struct {
+	w      io.Writer
+	format Format
+}
+
+func NewWriter(w io.Writer, format Format) *Writer {
+	if format == AutoFormat {
+		format = TSV
+	}
+	return &Writer{w: w, format: format}
+}
+
+// WriteHeader writes the header. The end timestamp is left for WriteTrailer.
+func (w *Writer) WriteHeader(h Header) error {
+	switch w.format {
+	case JSON:
+		return writeJSONHeader(w.w, h)
+	case Checksum:
+		return nil
+	}
+	return writeTSVHeader(w.w, h)
+}
+
+func (w *Writer) WriteEntry(e Entry) error {
+	switch w.format {
+	case JSON:
+		return writeJSONEntry(w.w, e)
+	case Checksum:
+		return writeChecksumEntry(w.w, e)
+	}
+	return writeTSVEntry(w.w, e)
+}
+
+// WriteTrailer writes the header entries known only after the scan.
+func (w *Writer) WriteTrailer(h Header) error {
+	switch w.format {
+	case JSON:
+		return writeJSONTrailer(w.w, h)
+	case Checksum:
+		return nil
+	}
+	return writeTSVTrailer(w.w, h)
+}
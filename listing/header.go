@@ -0,0 +1,114 @@
+package listing
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FormatVersion is the version of the listing format written by this tool. Version 2 added directory entries,
+// version 3 added the allocated size column, version 4 added several hashes per file.
+const FormatVersion = 4
+
+// HashSeparator separates the hashes of a file in listings with several hashes per file, e.g. "nXXX,hXXX". The hash
+// mode of such listings lists the modes in the same order, e.g. "n,h".
+const HashSeparator = ","
+
+// ToolVersion can be overridden at build time with -ldflags "-X greasytoad/listing.ToolVersion=...".
+var ToolVersion = "dev"
+
+// Header describes how a listing was made. It is written before the file entries. The end timestamp is known only
+// after the scan, so it is written as a trailer after the last entry.
+type Header struct {
+	// Version is 0 for legacy listings without a header.
+	Version   int
+	HashMode  string
+	Algorithm string
+	Root      string
+	Host      string
+	Start     time.Time
+	End       time.Time
+	Tool      string
+	// Refined is the hash mode of a listing before the refine command re-hashed the files that shared a hash with
+	// full content hashes, empty for other listings. The other files keep their hashes, which are unique in the listing.
+	Refined string
+}
+
+func (h Header) String() string {
+	return fmt.Sprintf("version=%d hash=%s algorithm=%s root=%s host=%s start=%s end=%s tool=%s refined=%s",
+		h.Version, h.HashMode, h.Algorithm, h.Root, h.Host, formatTime(h.Start), formatTime(h.End), h.Tool, h.Refined)
+}
+
+// CheckCompatible returns an error if file hashes from the two listings cannot be compared with each other. Listings
+// with unknown hash mode or algorithm are assumed compatible.
+func CheckCompatible(a, b Header) error {
+	if a.HashMode != "" && b.HashMode != "" && a.HashMode != b.HashMode {
+		return fmt.Errorf("different hash modes: %s and %s", a.HashMode, b.HashMode)
+	}
+	if a.Algorithm != "" && b.Algorithm != "" && a.Algorithm != b.Algorithm {
+		return fmt.Errorf("different hash algorithms: %s and %s", a.Algorithm, b.Algorithm)
+	}
+	return nil
+}
+
+// HashModeFromHash guesses the hash mode from the prefix of a file hash, for legacy listings without a header.
+func HashModeFromHash(fileHash string) string {
+	if fileHash == "" {
+		return ""
+	}
+	return fileHash[:1]
+}
+
+// HashModes returns the hash modes of a listing with several hashes per file, or the single hash mode.
+func HashModes(hashMode string) []string {
+	if hashMode == "" {
+		return nil
+	}
+	return strings.Split(hashMode, HashSeparator)
+}
+
+// selectHash sets the hash of an entry with several hashes to the hash of the given mode, or to the first hash if the
+// mode is empty. Entries with a single hash are left as they are. In refined listings, the files without a full
+// content hash get their first hash, which is unique in the listing.
+func selectHash(entry *Entry, mode string, refined bool) error {
+	if entry.Dir || !strings.Contains(entry.Hash, HashSeparator) {
+		return nil
+	}
+	hashes := strings.Split(entry.Hash, HashSeparator)
+	if mode == "" {
+		entry.Hash = hashes[0]
+		return nil
+	}
+	for _, h := range hashes {
+		if HashModeFromHash(h) == mode {
+			entry.Hash = h
+			return nil
+		}
+	}
+	if refined && mode == fullHashPrefix {
+		entry.Hash = hashes[0]
+		return nil
+	}
+	return fmt.Errorf("no hash of mode (%s): %s", mode, entry.Hash)
+}
+
+func checkVersion(version int) error {
+	if version > FormatVersion {
+		return fmt.Errorf("listing version %d is newer than supported version %d", version, FormatVersion)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,582 @@
+package listing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The index is a binary form of a listing that is fast to load. The path components and the hashes are interned in
+// string tables, and the files and directories are fixed width records, so the index can be memory mapped and read
+// without parsing. All the numbers are little endian.
+//
+//	magic                         [8]byte
+//	version, header, string, hash, node and entry counts     6 x uint32
+//	headers                       uint64 length, then the headers as length prefixed strings
+//	strings, hashes               (count+1) x uint64 offsets, then the concatenated strings
+//	                              hashes start with a byte: 0 for a plain string, 1 for a prefix and hex digits
+//	                              stored as a byte followed by the decoded bytes
+//	nodes                         count x nodeRecordSize
+//	entries                       count x uint32 node index, in the order of the listing
+//
+// Version 2 added the refined hash mode to the headers.
+//
+// A node is a file or a directory, the directories are shared by all their children. Directories without an entry
+// in the listing (e.g. in legacy listings) are nodes, but not entries. The parents come before their children.
+const (
+	IndexVersion   = 2
+	nodeRecordSize = 32
+	noIndex        = ^uint32(0)
+
+	nodeFlagDir = 1 << 0
+
+	hashPlain = 0
+	hashHex   = 1
+)
+
+var indexMagic = []byte("ddindex\x00")
+
+func isIndex(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(indexMagic))
+	return bytes.Equal(magic, indexMagic)
+}
+
+type indexHeader struct {
+	header     Header
+	firstEntry uint32
+}
+
+type indexNode struct {
+	parent    uint32
+	name      uint32
+	hash      uint32
+	flags     uint32
+	size      int64
+	allocated int64
+}
+
+// WriteIndex writes the entries of the reader as an index. The tables are built in memory, which needs much less
+// memory than the tree of the analysis.
+func WriteIndex(w io.Writer, r Reader) error {
+	strs := newStringTable(false)
+	hashes := newStringTable(true)
+	nodes := []indexNode{}
+	entries := []uint32{}
+	headers := []indexHeader{}
+	// dirs maps the path of a directory to its node.
+	dirs := make(map[string]uint32)
+
+	var dirNode func(path string) uint32
+	dirNode = func(path string) uint32 {
+		if i, ok := dirs[path]; ok {
+			return i
+		}
+		parent, name := noIndex, path
+		if slash := strings.LastIndex(path, "/"); slash >= 0 {
+			// the root of absolute paths is the directory with the empty name.
+			parent, name = dirNode(path[:slash]), path[slash+1:]
+		}
+		nodes = append(nodes, indexNode{parent: parent, name: strs.add(name), hash: noIndex, flags: nodeFlagDir})
+		dirs[path] = uint32(len(nodes) - 1)
+		return dirs[path]
+	}
+
+	seenHeaders := 0
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for ; seenHeaders < len(r.Headers()); seenHeaders++ {
+			headers = append(headers, indexHeader{firstEntry: uint32(len(entries))})
+		}
+		if entry.Dir {
+			entries = append(entries, dirNode(entry.Path))
+			continue
+		}
+		parent, name := noIndex, entry.Path
+		if slash := strings.LastIndex(entry.Path, "/"); slash >= 0 {
+			parent, name = dirNode(entry.Path[:slash]), entry.Path[slash+1:]
+		}
+		nodes = append(nodes, indexNode{
+			parent:    parent,
+			name:      strs.add(name),
+			hash:      hashes.add(entry.Hash),
+			size:      entry.Size,
+			allocated: entry.Allocated,
+		})
+		entries = append(entries, uint32(len(nodes)-1))
+	}
+	// the headers are complete only at the end, e.g. the end timestamp is in the trailer.
+	for i, h := range r.Headers() {
+		headers[i].header = *h
+	}
+
+	bw := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	bw.Write(indexMagic)
+	for _, n := range []int{IndexVersion, len(headers), strs.len(), hashes.len(), len(nodes), len(entries)} {
+		binary.Write(bw, le, uint32(n))
+	}
+
+	headersBuf := &bytes.Buffer{}
+	for _, h := range headers {
+		binary.Write(headersBuf, le, h.firstEntry)
+		binary.Write(headersBuf, le, int32(h.header.Version))
+		for _, s := range []string{h.header.HashMode, h.header.Algorithm, h.header.Root, h.header.Host,
+			formatTime(h.header.Start), formatTime(h.header.End), h.header.Tool, h.header.Refined} {
+			writeIndexString(headersBuf, s)
+		}
+	}
+	binary.Write(bw, le, uint64(headersBuf.Len()))
+	bw.Write(headersBuf.Bytes())
+
+	strs.write(bw)
+	hashes.write(bw)
+
+	record := make([]byte, nodeRecordSize)
+	for _, n := range nodes {
+		le.PutUint32(record[0:], n.parent)
+		le.PutUint32(record[4:], n.name)
+		le.PutUint32(record[8:], n.hash)
+		le.PutUint32(record[12:], n.flags)
+		le.PutUint64(record[16:], uint64(n.size))
+		le.PutUint64(record[24:], uint64(n.allocated))
+		bw.Write(record)
+	}
+	for _, e := range entries {
+		binary.Write(bw, le, e)
+	}
+	return bw.Flush()
+}
+
+// isInferred returns true for headers of legacy listings, which have only the fields guessed from the entries.
+func isInferred(h Header) bool {
+	return h.Version == 0 && h.Root == "" && h.Host == "" && h.Tool == "" && h.Start.IsZero() && h.Refined == ""
+}
+
+func writeIndexString(w io.Writer, s string) {
+	binary.Write(w, binary.LittleEndian, uint32(len(s)))
+	io.WriteString(w, s)
+}
+
+// stringTable interns strings, so repeated names and hashes are stored once.
+type stringTable struct {
+	index   map[string]uint32
+	strings []string
+	// compactHex stores hex digests in half the space.
+	compactHex bool
+}
+
+func newStringTable(compactHex bool) *stringTable {
+	return &stringTable{index: make(map[string]uint32), compactHex: compactHex}
+}
+
+func (t *stringTable) add(s string) uint32 {
+	if i, ok := t.index[s]; ok {
+		return i
+	}
+	t.strings = append(t.strings, s)
+	t.index[s] = uint32(len(t.strings) - 1)
+	return t.index[s]
+}
+
+func (t *stringTable) len() int {
+	return len(t.strings)
+}
+
+func (t *stringTable) write(w io.Writer) {
+	encoded := t.strings
+	if t.compactHex {
+		encoded = make([]string, len(t.strings))
+		for i, s := range t.strings {
+			encoded[i] = encodeHash(s)
+		}
+	}
+	var offset uint64 = 0
+	for _, s := range encoded {
+		binary.Write(w, binary.LittleEndian, offset)
+		offset += uint64(len(s))
+	}
+	binary.Write(w, binary.LittleEndian, offset)
+	for _, s := range encoded {
+		io.WriteString(w, s)
+	}
+}
+
+// encodeHash stores hashes like "h" followed by lowercase hex digits as the prefix and the decoded bytes.
+func encodeHash(s string) string {
+	if len(s) >= 3 && len(s)%2 == 1 {
+		if b, err := hex.DecodeString(s[1:]); err == nil && hex.EncodeToString(b) == s[1:] {
+			return string([]byte{hashHex, s[0]}) + string(b)
+		}
+	}
+	return string([]byte{hashPlain}) + s
+}
+
+func decodeHash(b []byte) string {
+	if len(b) > 1 && b[0] == hashHex {
+		return string(b[1:2]) + hex.EncodeToString(b[2:])
+	}
+	return string(b[1:])
+}
+
+// indexReader reads the entries of an index. The data is usually memory mapped, the records are decoded only when
+// the entries are read.
+type indexReader struct {
+	data    []byte
+	closer  io.Closer
+	headers []indexHeader
+	strs    indexStrings
+	hashes  indexStrings
+	nodes   []byte
+	entries []byte
+	next    int
+	// dirPaths caches the paths of the directories by node, since they are shared by many entries.
+	dirPaths map[uint32]string
+	// hashMode and allHashes select the hash of the files with several hashes, see ReaderOpts.
+	hashMode  string
+	allHashes bool
+}
+
+type indexStrings struct {
+	offsets    []byte
+	blob       []byte
+	compactHex bool
+}
+
+func (s indexStrings) get(i uint32) string {
+	le := binary.LittleEndian
+	b := s.blob[le.Uint64(s.offsets[uint64(i)*8:]):le.Uint64(s.offsets[uint64(i+1)*8:])]
+	if s.compactHex {
+		return decodeHash(b)
+	}
+	return string(b)
+}
+
+// validate checks that the offsets of the strings are in order within the blob, and that the hashes have the byte of
+// their form.
+func (s indexStrings) validate(count uint32) error {
+	le := binary.LittleEndian
+	start := le.Uint64(s.offsets)
+	for i := uint32(0); i < count; i++ {
+		end := le.Uint64(s.offsets[uint64(i+1)*8:])
+		if end < start || end > uint64(len(s.blob)) || (s.compactHex && end == start) {
+			return fmt.Errorf("bad offset of string %d", i)
+		}
+		start = end
+	}
+	return nil
+}
+
+func newIndexReader(data []byte, closer io.Closer, opts ReaderOpts) (*indexReader, error) {
+	r := &indexReader{data: data, closer: closer, dirPaths: make(map[uint32]string), hashMode: opts.HashMode, allHashes: opts.AllHashes}
+	if err := r.parse(); err != nil {
+		closer.Close()
+		return nil, fmt.Errorf("bad index: %v", err)
+	}
+	if !r.allHashes {
+		for i := range r.headers {
+			r.headers[i].header.HashMode = r.selectedHashMode(r.headers[i].header)
+		}
+	}
+	return r, nil
+}
+
+// selectedHashMode returns the hash mode of the listing of the header after selecting a hash of the files, like
+// lineReader.inferHeader.
+func (r *indexReader) selectedHashMode(h Header) string {
+	modes := HashModes(h.HashMode)
+	switch {
+	case len(modes) < 2:
+		return h.HashMode
+	case h.Refined != "" && (r.hashMode == "" || r.hashMode == fullHashPrefix):
+		return fullHashPrefix
+	case r.hashMode != "":
+		return r.hashMode
+	}
+	return modes[0]
+}
+
+// selectHash selects the hash of a file of the entry with the index like lineReader.selectHash, or of any entry for a
+// negative index.
+func (r *indexReader) selectHash(entry *Entry, index int) error {
+	if r.allHashes {
+		return nil
+	}
+	refined := false
+	for _, h := range r.headers {
+		switch {
+		case index < 0:
+			refined = refined || h.header.Refined != ""
+		case int(h.firstEntry) <= index:
+			// the last header started before the entry is the header of its listing.
+			refined = h.header.Refined != ""
+		}
+	}
+	return selectHash(entry, r.hashMode, refined)
+}
+
+func (r *indexReader) parse() (err error) {
+	defer func() {
+		// the slicing below panics on truncated data.
+		if p := recover(); p != nil {
+			err = fmt.Errorf("truncated: %v", p)
+		}
+	}()
+	le := binary.LittleEndian
+	data := r.data
+	if !bytes.HasPrefix(data, indexMagic) {
+		return fmt.Errorf("no magic bytes")
+	}
+	data = data[len(indexMagic):]
+	counts := make([]uint32, 6)
+	for i := range counts {
+		counts[i], data = le.Uint32(data), data[4:]
+	}
+	version, headerCount, stringCount, hashCount, nodeCount, entryCount := counts[0], counts[1], counts[2], counts[3], counts[4], counts[5]
+	if version > IndexVersion {
+		return fmt.Errorf("index version %d is newer than supported version %d", version, IndexVersion)
+	}
+
+	headersLen := le.Uint64(data)
+	headersData, data := data[8:8+headersLen], data[8+headersLen:]
+	for i := uint32(0); i < headerCount; i++ {
+		h := indexHeader{}
+		h.firstEntry, headersData = le.Uint32(headersData), headersData[4:]
+		h.header.Version, headersData = int(int32(le.Uint32(headersData))), headersData[4:]
+		fields := make([]string, 8)
+		if version < 2 {
+			fields = fields[:7]
+		}
+		for j := range fields {
+			n := le.Uint32(headersData)
+			fields[j], headersData = string(headersData[4:4+n]), headersData[4+n:]
+		}
+		h.header.HashMode, h.header.Algorithm, h.header.Root, h.header.Host, h.header.Tool = fields[0], fields[1], fields[2], fields[3], fields[6]
+		if len(fields) > 7 {
+			h.header.Refined = fields[7]
+		}
+		if h.header.Start, err = parseTime(fields[4]); err != nil {
+			return err
+		}
+		if h.header.End, err = parseTime(fields[5]); err != nil {
+			return err
+		}
+		r.headers = append(r.headers, h)
+	}
+
+	readStrings := func(count uint32, compactHex bool) indexStrings {
+		offsetsLen := uint64(count+1) * 8
+		s := indexStrings{offsets: data[:offsetsLen], compactHex: compactHex}
+		blobLen := le.Uint64(s.offsets[uint64(count)*8:])
+		s.blob, data = data[offsetsLen:offsetsLen+blobLen], data[offsetsLen+blobLen:]
+		return s
+	}
+	r.strs = readStrings(stringCount, false)
+	r.hashes = readStrings(hashCount, true)
+
+	r.nodes, data = data[:uint64(nodeCount)*nodeRecordSize], data[uint64(nodeCount)*nodeRecordSize:]
+	r.entries = data[:uint64(entryCount)*4]
+	return r.validate(stringCount, hashCount, nodeCount, entryCount)
+}
+
+// validate checks the indexes between the tables, so a corrupted index is an error here and not a panic when the
+// entries are read.
+func (r *indexReader) validate(stringCount, hashCount, nodeCount, entryCount uint32) error {
+	le := binary.LittleEndian
+	for _, h := range r.headers {
+		if h.firstEntry > entryCount {
+			return fmt.Errorf("header starts at entry %d of %d", h.firstEntry, entryCount)
+		}
+	}
+	if err := r.strs.validate(stringCount); err != nil {
+		return fmt.Errorf("strings: %v", err)
+	}
+	if err := r.hashes.validate(hashCount); err != nil {
+		return fmt.Errorf("hashes: %v", err)
+	}
+	for i := uint32(0); i < nodeCount; i++ {
+		n := r.node(i)
+		// the parents come before their children, so the paths cannot loop.
+		if n.parent != noIndex && (n.parent >= i || r.node(n.parent).flags&nodeFlagDir == 0) {
+			return fmt.Errorf("node %d has bad parent %d", i, n.parent)
+		}
+		if n.name >= stringCount {
+			return fmt.Errorf("node %d has bad name %d", i, n.name)
+		}
+		if n.flags&nodeFlagDir == 0 && n.hash >= hashCount {
+			return fmt.Errorf("node %d has bad hash %d", i, n.hash)
+		}
+	}
+	for i := uint32(0); i < entryCount; i++ {
+		if node := le.Uint32(r.entries[i*4:]); node >= nodeCount {
+			return fmt.Errorf("entry %d has bad node %d", i, node)
+		}
+	}
+	return nil
+}
+
+func (r *indexReader) node(i uint32) indexNode {
+	le := binary.LittleEndian
+	record := r.nodes[uint64(i)*nodeRecordSize:]
+	return indexNode{
+		parent:    le.Uint32(record[0:]),
+		name:      le.Uint32(record[4:]),
+		hash:      le.Uint32(record[8:]),
+		flags:     le.Uint32(record[12:]),
+		size:      int64(le.Uint64(record[16:])),
+		allocated: int64(le.Uint64(record[24:])),
+	}
+}
+
+func (r *indexReader) path(n indexNode) string {
+	name := r.strs.get(n.name)
+	if n.parent == noIndex {
+		return name
+	}
+	return r.dirPath(n.parent) + "/" + name
+}
+
+func (r *indexReader) dirPath(i uint32) string {
+	if p, ok := r.dirPaths[i]; ok {
+		return p
+	}
+	p := r.path(r.node(i))
+	r.dirPaths[i] = p
+	return p
+}
+
+func (r *indexReader) Next() (Entry, error) {
+	if r.next*4 >= len(r.entries) {
+		return Entry{}, io.EOF
+	}
+	i := binary.LittleEndian.Uint32(r.entries[r.next*4:])
+	r.next++
+	n := r.node(i)
+	if n.flags&nodeFlagDir != 0 {
+		return Entry{Path: r.dirPath(i), Dir: true}, nil
+	}
+	entry := Entry{
+		Path:      r.path(n),
+		Size:      n.size,
+		Hash:      r.hashes.get(n.hash),
+		Allocated: n.allocated,
+	}
+	if err := r.selectHash(&entry, r.next-1); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+func (r *indexReader) Format() Format {
+	return Index
+}
+
+func (r *indexReader) ReadTree(onNode func(TreeNode) error) error {
+	count := len(r.nodes) / nodeRecordSize
+	for i := 0; i < count; i++ {
+		n := r.node(uint32(i))
+		tn := TreeNode{
+			Index:     i,
+			Parent:    -1,
+			Name:      r.strs.get(n.name),
+			Dir:       n.flags&nodeFlagDir != 0,
+			Size:      n.size,
+			Allocated: n.allocated,
+			HashIndex: -1,
+		}
+		if n.parent != noIndex {
+			tn.Parent = int(n.parent)
+		}
+		if !tn.Dir {
+			tn.HashIndex = int(n.hash)
+		}
+		if err := onNode(tn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *indexReader) Hash(hashIndex int) (string, error) {
+	entry := Entry{Hash: r.hashes.get(uint32(hashIndex))}
+	// the hashes are shared by the files of all the listings.
+	err := r.selectHash(&entry, -1)
+	return entry.Hash, err
+}
+
+func (r *indexReader) Path(nodeIndex int) string {
+	return r.path(r.node(uint32(nodeIndex)))
+}
+
+// Headers returns all the headers, the index holds complete headers from the start.
+func (r *indexReader) Headers() []*Header {
+	headers := []*Header{}
+	for i := range r.headers {
+		headers = append(headers, &r.headers[i].header)
+	}
+	return headers
+}
+
+// headerStarts returns the index of the first entry of each header, for concatenated listings.
+func (r *indexReader) headerStarts() []int {
+	starts := []int{}
+	for _, h := range r.headers {
+		starts = append(starts, int(h.firstEntry))
+	}
+	return starts
+}
+
+func (r *indexReader) Close() error {
+	return r.closer.Close()
+}
+
+// WriteListing writes the entries of the reader as a text listing, with the headers at the same places as in the
+// original listing. Legacy listings without a header are written without a header.
+func WriteListing(w *Writer, r Reader) error {
+	var starts []int
+	if ir, ok := r.(*indexReader); ok {
+		starts = ir.headerStarts()
+	}
+	var current *Header
+	writeTrailer := func() error {
+		if current == nil || current.End.IsZero() {
+			return nil
+		}
+		return w.WriteTrailer(*current)
+	}
+	seenHeaders := 0
+	for i := 0; ; i++ {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for ; seenHeaders < len(r.Headers()) && (starts == nil || starts[seenHeaders] <= i); seenHeaders++ {
+			if err := writeTrailer(); err != nil {
+				return err
+			}
+			current = r.Headers()[seenHeaders]
+			if isInferred(*current) {
+				continue
+			}
+			if err := w.WriteHeader(*current); err != nil {
+				return err
+			}
+		}
+		if err := w.WriteEntry(entry); err != nil {
+			return err
+		}
+	}
+	return writeTrailer()
+}
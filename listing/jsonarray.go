@@ -0,0 +1,110 @@
+package listing
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// isJSONArray peeks at the input to check if it is a JSON array, as written by rmlint or rclone.
+func isJSONArray(r *bufio.Reader) bool {
+	for i := 1; ; i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			return false
+		}
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// jsonArrayReader reads listings that are a single JSON array, element by element, so the whole array is never held
+// in memory. The format is detected from the first element if not given.
+type jsonArrayReader struct {
+	decoder      *json.Decoder
+	decompressed io.Closer
+	format       Format
+	header       *Header
+	started      bool
+}
+
+func newJSONArrayReader(r io.Reader, decompressed io.Closer, format Format) *jsonArrayReader {
+	return &jsonArrayReader{
+		decoder:      json.NewDecoder(r),
+		decompressed: decompressed,
+		format:       format,
+	}
+}
+
+func (r *jsonArrayReader) Next() (Entry, error) {
+	if !r.started {
+		r.started = true
+		if t, err := r.decoder.Token(); err != nil {
+			return Entry{}, err
+		} else if t != json.Delim('[') {
+			return Entry{}, fmt.Errorf("bad %s output: expected a JSON array", r.format)
+		}
+	}
+	for r.decoder.More() {
+		raw := json.RawMessage{}
+		if err := r.decoder.Decode(&raw); err != nil {
+			return Entry{}, fmt.Errorf("bad %s output: %v", r.format, err)
+		}
+		if r.format == AutoFormat {
+			if isRmlintRecord(raw) {
+				r.format = Rmlint
+			} else {
+				r.format = Rclone
+			}
+		}
+		if r.header == nil {
+			if r.format == Rmlint {
+				r.header = newRmlintHeader()
+			} else {
+				r.header = &Header{}
+			}
+		}
+
+		var entry Entry
+		var ok bool
+		var err error
+		if r.format == Rmlint {
+			entry, ok, err = parseRmlintRecord(r.header, raw)
+		} else {
+			entry, ok, err = parseRcloneRecord(raw)
+		}
+		if err != nil {
+			return Entry{}, err
+		}
+		if !ok {
+			continue
+		}
+		if !entry.Dir {
+			inferHeader(r.header, entry)
+		}
+		return entry, nil
+	}
+	return Entry{}, io.EOF
+}
+
+func (r *jsonArrayReader) Format() Format {
+	return r.format
+}
+
+func (r *jsonArrayReader) Headers() []*Header {
+	if r.header == nil {
+		return nil
+	}
+	return []*Header{r.header}
+}
+
+func (r *jsonArrayReader) Close() error {
+	return r.decompressed.Close()
+}
@@ -0,0 +1,153 @@
+package listing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// jsonHeaderLine is either {"header":{...}} or {"trailer":{...}}. Other lines are file or directory entries.
+type jsonHeaderLine struct {
+	Header  *jsonHeader `json:"header,omitempty"`
+	Trailer *jsonHeader `json:"trailer,omitempty"`
+}
+
+// jsonDirLine is used for writing directories, so they do not carry irrelevant fields.
+type jsonDirLine struct {
+	Path string `json:"path"`
+	Dir  bool   `json:"dir"`
+}
+
+type jsonHeader struct {
+	Version   int    `json:"version,omitempty"`
+	HashMode  string `json:"hash_mode,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Root      string `json:"root,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Start     string `json:"start,omitempty"`
+	End       string `json:"end,omitempty"`
+	Tool      string `json:"tool,omitempty"`
+	Refined   string `json:"refined,omitempty"`
+}
+
+type jsonEntry struct {
+	Path      string `json:"path,omitempty"`
+	Dir       bool   `json:"dir,omitempty"`
+	Size      int64  `json:"size"`
+	Hash      string `json:"hash,omitempty"`
+	Allocated *int64 `json:"allocated,omitempty"`
+}
+
+func isJSONHeaderLine(line string) bool {
+	return strings.HasPrefix(line, `{"header":`) || strings.HasPrefix(line, `{"trailer":`)
+}
+
+func isJSONHeaderStart(line string) bool {
+	return strings.HasPrefix(line, `{"header":`)
+}
+
+func parseJSONHeaderLine(h *Header, line string) error {
+	parsed := jsonHeaderLine{}
+	if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+		return fmt.Errorf("bad header line: %v, `%v`", err, line)
+	}
+	for _, jh := range []*jsonHeader{parsed.Header, parsed.Trailer} {
+		if jh == nil {
+			continue
+		}
+		if err := jh.update(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update sets the header fields present in the JSON header.
+func (jh *jsonHeader) update(h *Header) error {
+	if jh.Version != 0 {
+		if err := checkVersion(jh.Version); err != nil {
+			return err
+		}
+		h.Version = jh.Version
+	}
+	updateString := func(dest *string, value string) {
+		if value != "" {
+			*dest = value
+		}
+	}
+	updateString(&h.HashMode, jh.HashMode)
+	updateString(&h.Algorithm, jh.Algorithm)
+	updateString(&h.Root, jh.Root)
+	updateString(&h.Host, jh.Host)
+	updateString(&h.Tool, jh.Tool)
+	updateString(&h.Refined, jh.Refined)
+	var err error
+	if jh.Start != "" {
+		if h.Start, err = parseTime(jh.Start); err != nil {
+			return err
+		}
+	}
+	if jh.End != "" {
+		if h.End, err = parseTime(jh.End); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseJSONEntry(line string) (Entry, error) {
+	parsed := jsonEntry{}
+	if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+		return Entry{}, fmt.Errorf("bad line: %v, `%v`", err, line)
+	}
+	if parsed.Path == "" {
+		return Entry{}, fmt.Errorf("bad line: no path, `%v`", line)
+	}
+	entry := Entry{
+		Path: strings.TrimSuffix(parsed.Path, "/"),
+		Dir:  parsed.Dir,
+		Size: parsed.Size,
+		Hash: parsed.Hash,
+	}
+	if parsed.Allocated != nil {
+		entry.Allocated = *parsed.Allocated
+	} else {
+		entry.Allocated = parsed.Size
+	}
+	return entry, nil
+}
+
+func writeJSONHeader(w io.Writer, h Header) error {
+	return writeJSONLine(w, jsonHeaderLine{Header: &jsonHeader{
+		Version:   h.Version,
+		HashMode:  h.HashMode,
+		Algorithm: h.Algorithm,
+		Root:      h.Root,
+		Host:      h.Host,
+		Start:     formatTime(h.Start),
+		Tool:      h.Tool,
+		Refined:   h.Refined,
+	}})
+}
+
+func writeJSONTrailer(w io.Writer, h Header) error {
+	return writeJSONLine(w, jsonHeaderLine{Trailer: &jsonHeader{End: formatTime(h.End)}})
+}
+
+func writeJSONEntry(w io.Writer, e Entry) error {
+	if e.Dir {
+		return writeJSONLine(w, jsonDirLine{Path: e.Path, Dir: true})
+	}
+	return writeJSONLine(w, jsonEntry{Path: e.Path, Size: e.Size, Hash: e.Hash, Allocated: &e.Allocated})
+}
+
+func writeJSONLine(w io.Writer, line interface{}) error {
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,222 @@
+package listing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{Path: "a/x1", Hash: "he8a5da2185eb0563c20079ce3ca263ba"},
+		{Path: "a/new\nline", Hash: "he2ee9ad17fdffb4d4085276497dfb647"},
+		{Path: `a/back\slash`, Hash: "he2ee9ad17fdffb4d4085276497dfb647"},
+	}
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf, Checksum)
+	assert.NoError(t, w.WriteEntry(Entry{Path: "a", Dir: true}))
+	for _, e := range entries {
+		assert.NoError(t, w.WriteEntry(e))
+	}
+	assert.Equal(t, "e8a5da2185eb0563c20079ce3ca263ba  a/x1\n"+
+		"\\e2ee9ad17fdffb4d4085276497dfb647  a/new\\nline\n"+
+		"\\e2ee9ad17fdffb4d4085276497dfb647  a/back\\\\slash\n", buf.String())
+
+	r, err := NewReader(buf, AutoFormat)
+	assert.NoError(t, err)
+	for _, expected := range entries {
+		e, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Path, e.Path)
+		assert.Equal(t, expected.Hash, e.Hash)
+		assert.Equal(t, "md5", e.Algorithm)
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, Checksum, r.Format())
+}
+
+func TestChecksumRefusesNotFullHash(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{}, Checksum)
+	assert.Error(t, w.WriteEntry(Entry{Path: "a/x1", Hash: "s1234"}))
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	listings := []string{
+		"#listing\t3\n#hash\th\n#algorithm\tmd5\n#root\t/foo\n#host\tbox\n#start\t2021-01-02T03:04:05Z\n#tool\tdev\n" +
+			"/foo/\t0\t-\t0\n/foo/e/\t0\t-\t0\n/foo/bar\t1\thb1\t4096\n/foo/baz/qux\t5000000000\thb1\t0\n#end\t2021-01-02T03:04:06Z\n" +
+			"#listing\t3\n#hash\tn\n#algorithm\tmd5\n#root\t/x\n#host\tbox\n#start\t2021-01-02T03:04:05Z\n#tool\tdev\n" +
+			"rel/a\t2\tna\t2\n",
+		// legacy listing without a header
+		"/foo/bar\t1\thb1\t1\n/foo/quux\t2\thq2\t2\n",
+		"#listing\t4\n#hash\th\n#algorithm\tmd5\n#root\t/foo\n#host\tbox\n#start\t2021-01-02T03:04:05Z\n#tool\tdev\n#refined\tn\n" +
+			"/foo/bar\t1\thb1\t1\n/foo/quux\t2\tnq2\t2\n#end\t2021-01-02T03:04:06Z\n",
+	}
+	for _, text := range listings {
+		r, err := NewReader(bytes.NewBufferString(text), AutoFormat)
+		assert.NoError(t, err)
+		index := &bytes.Buffer{}
+		assert.NoError(t, WriteIndex(index, r))
+
+		r, err = NewReader(index, AutoFormat)
+		assert.NoError(t, err)
+		dumped := &bytes.Buffer{}
+		assert.NoError(t, WriteListing(NewWriter(dumped, TSV), r))
+		assert.Equal(t, Index, r.Format())
+		assert.Equal(t, text, dumped.String())
+	}
+}
+
+func TestIndexSeveralHashes(t *testing.T) {
+	header := "#algorithm\tmd5\n#root\t/foo\n#host\tbox\n#start\t2021-01-02T03:04:05Z\n#tool\tdev\n"
+	text := "#listing\t3\n#hash\tn,h\n" + header + "/foo/bar\t1\tnb,hb1\t1\n/foo/quux\t2\tnq,hq2\t2\n"
+	r, err := NewReaderOpts(bytes.NewBufferString(text), ReaderOpts{AllHashes: true})
+	assert.NoError(t, err)
+	index := &bytes.Buffer{}
+	assert.NoError(t, WriteIndex(index, r))
+
+	// all the hashes are kept.
+	r, err = NewReaderOpts(bytes.NewReader(index.Bytes()), ReaderOpts{AllHashes: true})
+	assert.NoError(t, err)
+	dumped := &bytes.Buffer{}
+	assert.NoError(t, WriteListing(NewWriter(dumped, TSV), r))
+	assert.Equal(t, text, dumped.String())
+
+	// a hash is selected like from the text listing.
+	r, err = NewReaderOpts(bytes.NewReader(index.Bytes()), ReaderOpts{HashMode: "h"})
+	assert.NoError(t, err)
+	dumped.Reset()
+	assert.NoError(t, WriteListing(NewWriter(dumped, TSV), r))
+	assert.Equal(t, "#listing\t3\n#hash\th\n"+header+"/foo/bar\t1\thb1\t1\n/foo/quux\t2\thq2\t2\n", dumped.String())
+
+	r, err = NewReaderOpts(bytes.NewReader(index.Bytes()), ReaderOpts{HashMode: "s"})
+	assert.NoError(t, err)
+	_, err = r.Next()
+	assert.Error(t, err)
+}
+
+func TestIndexTruncated(t *testing.T) {
+	r, err := NewReader(bytes.NewBufferString("/foo/bar\t1\thb1\t1\n"), AutoFormat)
+	assert.NoError(t, err)
+	index := &bytes.Buffer{}
+	assert.NoError(t, WriteIndex(index, r))
+
+	_, err = NewReader(bytes.NewBuffer(index.Bytes()[:index.Len()-10]), AutoFormat)
+	assert.Error(t, err)
+}
+
+func TestIndexCorrupted(t *testing.T) {
+	r, err := NewReader(bytes.NewBufferString("/foo/bar\t1\thb1\t1\n"), AutoFormat)
+	assert.NoError(t, err)
+	index := &bytes.Buffer{}
+	assert.NoError(t, WriteIndex(index, r))
+
+	// the last node is the file, followed by its entry.
+	lastNode := index.Len() - 4 - nodeRecordSize
+	for _, offset := range []int{lastNode, lastNode + 4, lastNode + 8, index.Len() - 4} {
+		data := append([]byte{}, index.Bytes()...)
+		binary.LittleEndian.PutUint32(data[offset:], 7)
+		_, err = NewReader(bytes.NewReader(data), AutoFormat)
+		assert.Error(t, err)
+	}
+}
+
+func TestParallelRead(t *testing.T) {
+	text := &bytes.Buffer{}
+	for i, hashMode := range []string{"h", "n"} {
+		fmt.Fprintf(text, "#listing\t%d\n#hash\t%s\n", FormatVersion, hashMode)
+		for j := 0; j < 3*parseBatchSize; j++ {
+			if j%1000 == 999 {
+				fmt.Fprintf(text, "malformed %d\n", j)
+			}
+			fmt.Fprintf(text, "/l%d/d%d/f%d\t%d\t%s%d\t4096\n", i, j/100, j, j, hashMode, j)
+		}
+	}
+	read := func(workers int) (string, []int) {
+		rejected := []int{}
+		opts := ReaderOpts{Workers: workers, OnReject: func(e *LineError) { rejected = append(rejected, e.Line) }}
+		r, err := NewReaderOpts(bytes.NewReader(text.Bytes()), opts)
+		assert.NoError(t, err)
+		dumped := &bytes.Buffer{}
+		assert.NoError(t, WriteListing(NewWriter(dumped, TSV), r))
+		return dumped.String(), rejected
+	}
+	serial, serialRejected := read(1)
+	parallel, parallelRejected := read(4)
+	assert.Equal(t, serial, parallel)
+	assert.Equal(t, serialRejected, parallelRejected)
+	assert.Len(t, serialRejected, 2*3*parseBatchSize/1000)
+}
+
+func TestRefine(t *testing.T) {
+	fullHashes := map[string]string{"/a/x": "h1", "/b/x": "h1", "/d/z": "h3", "/h/v": "h5", "/i/v": "h6"}
+	fullHash := func(e Entry) (string, error) {
+		if h, ok := fullHashes[e.Path]; ok {
+			return h, nil
+		}
+		return "", fmt.Errorf("size of %s changed", e.Path)
+	}
+	refine := func(text string) (string, RefineStats, []string) {
+		r, err := NewReaderOpts(bytes.NewBufferString(text), ReaderOpts{AllHashes: true})
+		assert.NoError(t, err)
+		recorded, err := Record(r)
+		assert.NoError(t, err)
+		failed := []string{}
+		stats := Refine(recorded, fullHash, func(e Entry, err error) { failed = append(failed, e.Path) })
+		refined := &bytes.Buffer{}
+		assert.NoError(t, WriteListing(NewWriter(refined, TSV), recorded))
+		return refined.String(), stats, failed
+	}
+	// hashes reads the listing like the analyze command.
+	hashes := func(text, mode string) (map[string]string, string) {
+		r, err := NewReaderOpts(bytes.NewBufferString(text), ReaderOpts{HashMode: mode})
+		assert.NoError(t, err)
+		found := make(map[string]string)
+		for {
+			e, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			found[e.Path] = e.Hash
+		}
+		return found, r.Headers()[0].HashMode
+	}
+
+	text := "#listing\t4\n#hash\tn\n/a/x\t1\tn1\n/b/x\t1\tn1\n/c/y\t2\tn2\n/d/z\t3\tn3\n/e/z\t3\tn3\n" +
+		"/f/w\t4\tn4\n/g/w\t4\tn4\n/h/v\t5\tn5\n/i/v\t5\tn5\n"
+	refined, stats, failed := refine(text)
+	assert.Equal(t, RefineStats{Groups: 4, Split: 1, Refined: 5, Failed: 3, ReadSize: 15, TotalSize: 28}, stats)
+	assert.Equal(t, []string{"/e/z", "/f/w", "/g/w"}, failed)
+	assert.Contains(t, refined, "#hash\th\n")
+	assert.Contains(t, refined, "#refined\tn\n")
+	found, mode := hashes(refined, "h")
+	assert.Equal(t, "h", mode)
+	assert.Equal(t, "h1", found["/a/x"])
+	assert.Equal(t, "h1", found["/b/x"])
+	assert.Equal(t, "n2", found["/c/y"])
+	assert.Equal(t, "h3", found["/d/z"])
+	// the files that could not be re-hashed are not duplicates of any file.
+	assert.True(t, strings.HasPrefix(found["/e/z"], UniqueHashMode))
+	assert.NotEqual(t, found["/f/w"], found["/g/w"])
+
+	// the files with several hashes keep them.
+	text = "#listing\t4\n#hash\tn,s\n/a/x\t1\tn1,s1\n/b/x\t1\tn1,s1\n/c/y\t2\tn2,s2\n"
+	refined, _, _ = refine(text)
+	assert.Contains(t, refined, "#hash\th,n,s\n")
+	assert.Contains(t, refined, "/a/x\t1\th1,n1,s1\t1\n")
+	assert.Contains(t, refined, "/c/y\t2\tn2,s2\t2\n")
+	for _, mode := range []string{"", "h"} {
+		found, headerMode := hashes(refined, mode)
+		assert.Equal(t, "h", headerMode)
+		assert.Equal(t, map[string]string{"/a/x": "h1", "/b/x": "h1", "/c/y": "n2"}, found)
+	}
+	found, mode = hashes(refined, "s")
+	assert.Equal(t, "s", mode)
+	assert.Equal(t, map[string]string{"/a/x": "s1", "/b/x": "s1", "/c/y": "s2"}, found)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package listing
+
+import (
+	"io"
+	"os"
+)
+
+// mapIndex is not supported, the index is read into memory by NewReaderOpts.
+func mapIndex(f *os.File) ([]byte, io.Closer, error) {
+	return nil, nil, nil
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package listing
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+// mapIndex memory maps the file if it is an index, and returns nil data otherwise. The file is left at the start.
+func mapIndex(f *os.File) ([]byte, io.Closer, error) {
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() < int64(len(indexMagic)) {
+		// e.g. stdin, which is read by the other readers.
+		return nil, nil, nil
+	}
+	magic := make([]byte, len(indexMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, indexMagic) {
+		return nil, nil, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &unmapper{data}, nil
+}
+
+type unmapper struct {
+	data []byte
+}
+
+func (u *unmapper) Close() error {
+	return syscall.Munmap(u.data)
+}
@@ -0,0 +1,363 @@
+package listing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Reader reads the entries of a listing.
+type Reader interface {
+	// Next returns the next file or directory entry, or io.EOF at the end of the input.
+	Next() (Entry, error)
+	// Format returns the format of the listing, it is known after the first call to Next.
+	Format() Format
+	// Headers returns the headers read so far. The headers are complete after Next returned io.EOF.
+	Headers() []*Header
+	Close() error
+}
+
+// TreeReader is implemented by the readers that can read the tree of directories directly, which is faster than
+// reading the entries one by one.
+type TreeReader interface {
+	Reader
+	// ReadTree calls onNode for all the files and directories, the parents before their children.
+	ReadTree(onNode func(TreeNode) error) error
+	// Hash returns the hash of a file by TreeNode.HashIndex, selected like the hashes of the entries.
+	Hash(hashIndex int) (string, error)
+	// Path returns the full path of a node by TreeNode.Index.
+	Path(nodeIndex int) string
+}
+
+// TreeNode is a file or a directory read by TreeReader.
+type TreeNode struct {
+	Index int
+	// Parent is -1 for the top level nodes.
+	Parent    int
+	Name      string
+	Dir       bool
+	Size      int64
+	Allocated int64
+	// HashIndex is the same for the same hashes, so the hashes are not compared as strings. -1 for directories.
+	HashIndex int
+}
+
+// ReaderOpts are the options of NewReaderOpts.
+type ReaderOpts struct {
+	// Format of the listing, detected from the content if not set.
+	Format Format
+	// S3Schema is the order of the columns of S3 Inventory CSV, DefaultS3Schema if not set.
+	S3Schema []string
+	// OnReject is called for the malformed lines, which are then skipped. If not set, the reader fails on the first
+	// malformed line. Malformed headers always fail.
+	OnReject func(*LineError)
+	// HashMode selects the hash of the listings with several hashes per file, the first hash if not set.
+	HashMode string
+	// AllHashes keeps all the hashes of the entries of listings with several hashes per file, and their hash mode.
+	AllHashes bool
+	// Workers is the number of goroutines that parse the lines of text listings. The lines are parsed one by one if
+	// it is 0 or 1.
+	Workers int
+}
+
+// LineError is an error in a line of a text listing.
+type LineError struct {
+	// Line is the line number, starting from 1.
+	Line int
+	// Text is the line as read.
+	Text string
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// NewReader returns a reader that decompresses the input and detects the format if not given.
+func NewReader(r io.Reader, format Format) (Reader, error) {
+	return NewReaderOpts(r, ReaderOpts{Format: format})
+}
+
+func NewReaderOpts(r io.Reader, opts ReaderOpts) (Reader, error) {
+	if f, ok := r.(*os.File); ok {
+		// an index in a regular file is memory mapped.
+		if data, closer, err := mapIndex(f); err != nil {
+			return nil, err
+		} else if data != nil {
+			return newIndexReader(data, closer, opts)
+		}
+	}
+	// compressed listings are detected by the magic bytes.
+	decompressed, err := NewDecompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(decompressed)
+	if isIndex(br) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		return newIndexReader(data, decompressed, opts)
+	}
+	format := opts.Format
+	if format == Rmlint || format == Rclone || (format == AutoFormat && isJSONArray(br)) {
+		return newJSONArrayReader(br, decompressed, format), nil
+	}
+	s3Schema := opts.S3Schema
+	if len(s3Schema) == 0 {
+		s3Schema = DefaultS3Schema
+	}
+	return &lineReader{
+		scanner:      bufio.NewScanner(br),
+		decompressed: decompressed,
+		format:       format,
+		s3Schema:     s3Schema,
+		onReject:     opts.OnReject,
+		hashMode:     opts.HashMode,
+		allHashes:    opts.AllHashes,
+		workers:      opts.Workers,
+	}, nil
+}
+
+// lineReader reads the listings with an entry per line.
+type lineReader struct {
+	scanner      *bufio.Scanner
+	decompressed io.Closer
+	format       Format
+	// headers holds a header per listing found in the input, there is more than one if listings were concatenated.
+	headers       []*Header
+	inferHashMode bool
+	fdupes        fdupesState
+	s3Schema      []string
+	onReject      func(*LineError)
+	// lineNumber is the number of the line returned last, scanned is the number of the lines read so far.
+	lineNumber int
+	scanned    int
+	hashMode   string
+	allHashes  bool
+	workers    int
+	// batch holds the lines read ahead and parsed by the workers.
+	batch []parsedLine
+}
+
+func (r *lineReader) Next() (Entry, error) {
+	for {
+		l, ok := r.nextLine()
+		if !ok {
+			break
+		}
+		r.lineNumber = l.number
+		if l.header {
+			if r.format.IsHeaderStart(l.text) || len(r.headers) == 0 {
+				r.headers = append(r.headers, &Header{})
+			}
+			if err := r.format.ParseHeaderLine(r.headers[len(r.headers)-1], l.text); err != nil {
+				return Entry{}, r.lineError(l.text, err)
+			}
+			r.inferHashMode = true
+			continue
+		}
+
+		entry := l.entry
+		err := l.err
+		if err == nil && l.ok {
+			// the hash is selected in order, as it depends on the header.
+			err = r.selectHash(&entry)
+		}
+		if err != nil {
+			lineErr := r.lineError(l.text, err)
+			if r.onReject == nil {
+				return Entry{}, lineErr
+			}
+			r.onReject(lineErr)
+			continue
+		}
+		if !l.ok {
+			continue
+		}
+
+		if len(r.headers) == 0 {
+			// legacy listing without a header.
+			r.headers = append(r.headers, &Header{})
+			r.inferHashMode = true
+		}
+		if r.inferHashMode && !entry.Dir {
+			r.inferHeader(entry)
+			r.inferHashMode = false
+		}
+		return entry, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Entry{}, err
+	}
+	return Entry{}, io.EOF
+}
+
+// parsedLine is a line of the listing, parsed unless it is a header line. The header lines are parsed in order, when
+// the line is returned by Next.
+type parsedLine struct {
+	text   string
+	number int
+	header bool
+	entry  Entry
+	// ok is false for the lines without an entry, e.g. of the fdupes output.
+	ok  bool
+	err error
+}
+
+// parseBatchSize is the number of lines parsed at once by the workers.
+const parseBatchSize = 4096
+
+// nextLine returns the next line that is not blank, or false at the end of the input.
+func (r *lineReader) nextLine() (parsedLine, bool) {
+	if r.workers <= 1 {
+		l, ok := r.scanLine()
+		if ok && !l.header {
+			l.entry, l.ok, l.err = r.parseLine(l.text)
+		}
+		return l, ok
+	}
+	if len(r.batch) == 0 {
+		r.batch = make([]parsedLine, 0, parseBatchSize)
+		for len(r.batch) < parseBatchSize {
+			l, ok := r.scanLine()
+			if !ok {
+				break
+			}
+			r.batch = append(r.batch, l)
+		}
+		if len(r.batch) == 0 {
+			return parsedLine{}, false
+		}
+		r.parseBatch()
+	}
+	l := r.batch[0]
+	r.batch = r.batch[1:]
+	return l, true
+}
+
+// scanLine reads the next line that is not blank, and detects the format from the first line.
+func (r *lineReader) scanLine() (parsedLine, bool) {
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		r.scanned++
+		if r.format != Fdupes && strings.TrimSpace(line) == "" {
+			// e.g. a leading new line of a heredoc. fdupes separates the groups with empty lines.
+			continue
+		}
+		if r.format == AutoFormat {
+			r.format = DetectFormat(line)
+		}
+		return parsedLine{text: line, number: r.scanned, header: r.format.IsHeaderLine(line)}, true
+	}
+	return parsedLine{}, false
+}
+
+// parseBatch parses the entries of the batch with the workers. The fdupes output is parsed in order, since the
+// entries depend on the previous lines.
+func (r *lineReader) parseBatch() {
+	if r.format == Fdupes {
+		for i := range r.batch {
+			if l := &r.batch[i]; !l.header {
+				l.entry, l.ok, l.err = r.parseLine(l.text)
+			}
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	chunk := (len(r.batch) + r.workers - 1) / r.workers
+	for start := 0; start < len(r.batch); start += chunk {
+		lines := r.batch[start:min(start+chunk, len(r.batch))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				if l := &lines[i]; !l.header {
+					l.entry, l.ok, l.err = r.parseLine(l.text)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// parseLine parses a line that is not a header. It returns false for the lines without an entry.
+func (r *lineReader) parseLine(line string) (Entry, bool, error) {
+	var entry Entry
+	var ok bool
+	var err error
+	switch r.format {
+	case Fdupes:
+		// fdupes output is not an entry per line, the groups are separated by empty lines.
+		entry, ok, err = r.fdupes.parseLine(line)
+	case S3Inventory:
+		// the columns depend on the configuration of the inventory.
+		entry, ok, err = parseS3InventoryEntry(r.s3Schema, line)
+	default:
+		entry, err = r.format.ParseEntry(line)
+		ok = true
+	}
+	return entry, ok, err
+}
+
+// selectHash selects the hash of an entry with several hashes by the options and the current header.
+func (r *lineReader) selectHash(entry *Entry) error {
+	if r.allHashes {
+		return nil
+	}
+	refined := len(r.headers) > 0 && r.headers[len(r.headers)-1].Refined != ""
+	return selectHash(entry, r.hashMode, refined)
+}
+
+// inferHeader fills the missing fields of the current header like inferHeader. The hash mode of listings with several
+// hashes per file is kept if all the hashes are kept, and is full content for refined listings unless another hash is
+// selected, as the files without a full content hash have a unique hash.
+func (r *lineReader) inferHeader(entry Entry) {
+	h := r.headers[len(r.headers)-1]
+	mode := h.HashMode
+	inferHeader(h, entry)
+	if !strings.Contains(mode, HashSeparator) {
+		return
+	}
+	switch {
+	case r.allHashes:
+		h.HashMode = mode
+	case h.Refined != "" && (r.hashMode == "" || r.hashMode == fullHashPrefix):
+		h.HashMode = fullHashPrefix
+	}
+}
+
+func (r *lineReader) lineError(line string, err error) *LineError {
+	return &LineError{Line: r.lineNumber, Text: line, Err: err}
+}
+
+func (r *lineReader) Format() Format {
+	return r.format
+}
+
+func (r *lineReader) Headers() []*Header {
+	return r.headers
+}
+
+func (r *lineReader) Close() error {
+	return r.decompressed.Close()
+}
+
+// inferHeader fills the header fields that are missing in legacy or foreign listings. The hash mode of listings with
+// several hashes per file is set to the mode of the selected hash.
+func inferHeader(h *Header, entry Entry) {
+	if h.HashMode == "" || strings.Contains(h.HashMode, HashSeparator) {
+		h.HashMode = HashModeFromHash(entry.Hash)
+	}
+	if h.Algorithm == "" {
+		h.Algorithm = entry.Algorithm
+	}
+}
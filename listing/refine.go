@@ -0,0 +1,169 @@
+package listing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// UniqueHashMode is the hash mode of the files that Refine could not re-hash. Their hashes are unique, so such files
+// are not duplicates of any other file.
+const UniqueHashMode = "u"
+
+// RecordedListing is a listing read into memory, so the entries can be changed before it is written, e.g. by Refine.
+// It replays the entries and the headers in the order they were read, so concatenated listings keep their headers.
+type RecordedListing struct {
+	Entries []Entry
+	format  Format
+	headers []*Header
+	// headerCounts is the number of headers read until each entry.
+	headerCounts []int
+	next         int
+}
+
+// Record reads all the entries of the reader.
+func Record(r Reader) (*RecordedListing, error) {
+	recorded := &RecordedListing{}
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		recorded.Entries = append(recorded.Entries, entry)
+		recorded.headerCounts = append(recorded.headerCounts, len(r.Headers()))
+	}
+	recorded.format = r.Format()
+	recorded.headers = r.Headers()
+	return recorded, nil
+}
+
+func (r *RecordedListing) Next() (Entry, error) {
+	if r.next >= len(r.Entries) {
+		return Entry{}, io.EOF
+	}
+	r.next++
+	return r.Entries[r.next-1], nil
+}
+
+func (r *RecordedListing) Format() Format {
+	return r.format
+}
+
+func (r *RecordedListing) Headers() []*Header {
+	if r.next == 0 || r.next > len(r.Entries) {
+		return r.headers
+	}
+	return r.headers[:r.headerCounts[r.next-1]]
+}
+
+func (r *RecordedListing) Close() error {
+	return nil
+}
+
+// RefineStats are the counts of a Refine call.
+type RefineStats struct {
+	// Groups is the number of the groups of files that shared a hash, Split of them had files with different content.
+	Groups int
+	Split  int
+	// Refined is the number of the files re-hashed, Failed of the files that could not be.
+	Refined int
+	Failed  int
+	// ReadSize is the size of the re-hashed files, TotalSize of all the files.
+	ReadSize  int64
+	TotalSize int64
+}
+
+// Refine replaces the hashes of the files that share their first hash with other files with the full content hashes
+// returned by fullHash, and sets Header.Refined. The files with a unique hash are not re-hashed, their content is
+// unique anyway. The files with several hashes keep the others after the full content hash. The files that fullHash
+// fails for, e.g. the files changed since the listing was made, get a hash of UniqueHashMode, so they are not
+// duplicates of the files they shared the hash with. onError is called for them.
+func Refine(recorded *RecordedListing, fullHash func(Entry) (string, error), onError func(Entry, error)) RefineStats {
+	stats := RefineStats{}
+	// groups are the indexes of the entries by their first hash, in the order of the first entry of each group.
+	groups := make(map[string][]int)
+	order := []string{}
+	for i, e := range recorded.Entries {
+		if e.Dir {
+			continue
+		}
+		if e.Size > 0 {
+			stats.TotalSize += e.Size
+		}
+		if hasHashMode(e.Hash, fullHashPrefix) || hasHashMode(e.Hash, UniqueHashMode) {
+			continue
+		}
+		first, _, _ := strings.Cut(e.Hash, HashSeparator)
+		if _, ok := groups[first]; !ok {
+			order = append(order, first)
+		}
+		groups[first] = append(groups[first], i)
+	}
+
+	for _, first := range order {
+		group := groups[first]
+		if len(group) < 2 {
+			continue
+		}
+		stats.Groups++
+		refined := make(map[string]bool)
+		for _, i := range group {
+			e := &recorded.Entries[i]
+			h, err := fullHash(*e)
+			if err != nil {
+				onError(*e, err)
+				h = uniqueHash(i, *e)
+				stats.Failed++
+			} else {
+				refined[h] = true
+				stats.Refined++
+				stats.ReadSize += e.Size
+			}
+			if strings.Contains(e.Hash, HashSeparator) {
+				e.Hash = h + HashSeparator + e.Hash
+			} else {
+				e.Hash = h
+			}
+		}
+		if len(refined) > 1 {
+			stats.Split++
+		}
+	}
+
+	for _, h := range recorded.headers {
+		modes := HashModes(h.HashMode)
+		if len(modes) == 0 || hasHashMode(h.HashMode, fullHashPrefix) {
+			continue
+		}
+		h.Refined = h.HashMode
+		if len(modes) == 1 {
+			// the refined files have only the full content hash.
+			h.HashMode = fullHashPrefix
+		} else {
+			h.HashMode = strings.Join(append([]string{fullHashPrefix}, modes...), HashSeparator)
+		}
+	}
+	return stats
+}
+
+// hasHashMode returns true if one of the hashes, or one of the hash modes of a header, is of the mode.
+func hasHashMode(hashes, mode string) bool {
+	for _, h := range strings.Split(hashes, HashSeparator) {
+		if HashModeFromHash(h) == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueHash returns a hash of UniqueHashMode for the entry with the index in the listing, as the same path may be in
+// several concatenated listings.
+func uniqueHash(index int, e Entry) string {
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s", index, e.Path)))
+	return UniqueHashMode + hex.EncodeToString(digest[:])
+}
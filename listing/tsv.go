@@ -0,0 +1,146 @@
+package listing
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	headerPrefix = "#"
+	dirNilHash   = "-"
+
+	keyVersion   = "listing"
+	keyHashMode  = "hash"
+	keyAlgorithm = "algorithm"
+	keyRoot      = "root"
+	keyHost      = "host"
+	keyStart     = "start"
+	keyEnd       = "end"
+	keyTool      = "tool"
+	keyRefined   = "refined"
+)
+
+func isTSVHeaderLine(line string) bool {
+	return strings.HasPrefix(line, headerPrefix)
+}
+
+func isTSVHeaderStart(line string) bool {
+	return strings.HasPrefix(line, headerPrefix+keyVersion+"\t")
+}
+
+// parseTSVHeaderLine ignores unknown keys, so newer tools can add entries.
+func parseTSVHeaderLine(h *Header, line string) error {
+	line = strings.TrimPrefix(strings.TrimRight(line, "\r\n"), headerPrefix)
+	parts := strings.SplitN(line, "\t", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad header line: `%v`", line)
+	}
+	key, value := parts[0], parts[1]
+	var err error
+	switch key {
+	case keyVersion:
+		h.Version, err = strconv.Atoi(value)
+		if err == nil {
+			err = checkVersion(h.Version)
+		}
+	case keyHashMode:
+		h.HashMode = value
+	case keyAlgorithm:
+		h.Algorithm = value
+	case keyRoot:
+		h.Root = value
+	case keyHost:
+		h.Host = value
+	case keyStart:
+		h.Start, err = parseTime(value)
+	case keyEnd:
+		h.End, err = parseTime(value)
+	case keyTool:
+		h.Tool = value
+	case keyRefined:
+		h.Refined = value
+	}
+	return err
+}
+
+// parseTSVEntry parses "path<TAB>size<TAB>hash[<TAB>allocated]". Directory paths end with a slash.
+func parseTSVEntry(line string) (Entry, error) {
+	line = strings.Trim(line, "\n")
+	entry := Entry{}
+	partCount := strings.Count(line, "\t") + 1
+	if partCount != 3 && partCount != 4 {
+		return entry, fmt.Errorf("bad line: %d parts, `%v`", partCount, line)
+	}
+	// the parts are cut without allocating a slice for each line.
+	var parts [4]string
+	rest := line
+	for i := 0; i < partCount-1; i++ {
+		parts[i], rest, _ = strings.Cut(rest, "\t")
+	}
+	parts[partCount-1] = rest
+	entry.Path = parts[0]
+	if strings.HasSuffix(entry.Path, "/") {
+		entry.Dir = true
+		entry.Path = strings.TrimSuffix(entry.Path, "/")
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return entry, err
+	}
+	entry.Size = size
+	entry.Hash = parts[2]
+	if partCount == 4 {
+		allocated, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return entry, err
+		}
+		entry.Allocated = allocated
+	} else {
+		// listings without the allocated size column.
+		entry.Allocated = size
+	}
+	return entry, nil
+}
+
+func writeTSVHeader(w io.Writer, h Header) error {
+	entries := [][2]string{
+		{keyVersion, strconv.Itoa(h.Version)},
+		{keyHashMode, h.HashMode},
+		{keyAlgorithm, h.Algorithm},
+		{keyRoot, h.Root},
+		{keyHost, h.Host},
+		{keyStart, formatTime(h.Start)},
+		{keyTool, h.Tool},
+	}
+	if h.Refined != "" {
+		// only refined listings have the entry, so other listings read the same by older tools.
+		entries = append(entries, [2]string{keyRefined, h.Refined})
+	}
+	for _, e := range entries {
+		if err := writeTSVHeaderEntry(w, e[0], e[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTSVTrailer(w io.Writer, h Header) error {
+	return writeTSVHeaderEntry(w, keyEnd, formatTime(h.End))
+}
+
+func writeTSVHeaderEntry(w io.Writer, key, value string) error {
+	_, err := fmt.Fprintf(w, "%s%s\t%s\n", headerPrefix, key, value)
+	return err
+}
+
+func writeTSVEntry(w io.Writer, e Entry) error {
+	var err error
+	if e.Dir {
+		_, err = fmt.Fprintf(w, "%s/\t0\t%s\t0\n", e.Path, dirNilHash)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\t%d\t%s\t%d\n", e.Path, e.Size, e.Hash, e.Allocated)
+	}
+	return err
+}
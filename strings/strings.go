@@ -7,12 +7,18 @@ const (
 	KB
 	MB
 	GB
+	TB
+	PB
 )
 
-func FormatBytes(size int) string {
-	var f float32 = float32(size)
+func FormatBytes(size int64) string {
+	var f float64 = float64(size)
 	u := "B"
 	switch {
+	case size >= PB:
+		f, u = f/PB, "PB"
+	case size >= TB:
+		f, u = f/TB, "TB"
 	case size >= GB:
 		f, u = f/GB, "GB"
 	case size >= MB: